@@ -1,5 +1,7 @@
 $(function() {
     var demo = false;
+    // names of the dns response codes by their value
+    var rcodes = ["NOERROR", "FORMERR", "SERVFAIL", "NXDOMAIN", "NOTIMP", "REFUSED"];
     var vis = (function(){
         var stateKey, eventKey, keys = {
             hidden: "visibilitychange",
@@ -88,7 +90,8 @@ $(function() {
                                 lastTime = lastTime - step;
                                 $this.data.unshift({
                                     Time: lastTime,
-                                    ResponseTime: 0,
+                                    ResponseTime: -1,
+                                    Outcome: "no data",
                                 });
                             }
                             $this.drawGraph();
@@ -193,7 +196,69 @@ $(function() {
             },
 
             showSelectedValue: function(i) {
-                this.activeValueEl.innerHTML = d3.timeFormat('%a %b %Y %H:%M:%S')(this.data[i].Time) + "\n" +  this.data[i].ResponseTime.toFixed(1) + "ms";
+                var value = this.data[i].ResponseTime.toFixed(1) + "ms";
+                if (this.data[i].Outcome && this.data[i].Outcome != "ok") {
+                    value = this.data[i].Outcome;
+                    if (this.data[i].Reporter) {
+                        value += " (code " + this.data[i].Code + ") from " + this.data[i].Reporter;
+                    }
+                    if (this.data[i].MTU) {
+                        value += ", MTU " + this.data[i].MTU;
+                    }
+                    if (this.data[i].StatusCode) {
+                        value += " (status " + this.data[i].StatusCode + ")";
+                    }
+                } else if (this.data[i].TTL) {
+                    value += " (TTL " + this.data[i].TTL + ")";
+                } else if (this.data[i].FirstByteTime) {
+                    var phases = [];
+                    if (this.data[i].DNSTime) {
+                        phases.push("dns " + this.data[i].DNSTime.toFixed(1) + "ms");
+                    }
+                    if (this.data[i].ConnectTime) {
+                        phases.push("connect " + this.data[i].ConnectTime.toFixed(1) + "ms");
+                    }
+                    if (this.data[i].TLSTime) {
+                        phases.push("tls " + this.data[i].TLSTime.toFixed(1) + "ms");
+                    }
+                    phases.push("first byte " + this.data[i].FirstByteTime.toFixed(1) + "ms");
+                    value += " (status " + this.data[i].StatusCode + ", " + phases.join(", ") + ")";
+                }
+                if (this.data[i].Sent) {
+                    if (this.data[i].ResponseTime >= 0) {
+                        value += " (" + this.data[i].MinResponseTime.toFixed(1) + "/" + this.data[i].MaxResponseTime.toFixed(1) + "ms, σ " + (this.data[i].StdDev || 0).toFixed(1) + "ms, jitter " + (this.data[i].Jitter || 0).toFixed(1) + "ms)";
+                    }
+                    value += ", " + (this.data[i].Loss || 0).toFixed(0) + "% of " + this.data[i].Sent + " lost";
+                }
+                if (this.data[i].InterarrivalJitter) {
+                    value += ", jitter " + this.data[i].InterarrivalJitter.toFixed(1) + "ms";
+                }
+                if (this.peer.Type !== "udp" && this.data[i].Reordered) {
+                    value += ", reordered";
+                }
+                if (this.data[i].Duplicates) {
+                    value += ", " + this.data[i].Duplicates + " duplicates";
+                }
+                if (this.data[i].MOS) {
+                    value += ", call quality " + this.data[i].MOS.toFixed(1) + "/5 (R " + (this.data[i].RFactor || 0).toFixed(0) + ")";
+                }
+                if (this.peer.Type === "udp" && this.data[i].Outcome == "ok") {
+                    var variation = function(ms) {
+                        return (ms >= 0 ? "+" : "") + (ms || 0).toFixed(1) + "ms";
+                    };
+                    value += " (→ " + variation(this.data[i].ForwardDelayVariation) + ", ← " + variation(this.data[i].BackwardDelayVariation) + ")";
+                    if (this.data[i].Reordered) {
+                        value += " reordered";
+                    }
+                }
+                if (this.peer.Type === "dns" && (this.data[i].Outcome == "ok" || this.data[i].Outcome == "bad rcode")) {
+                    var rcode = this.data[i].Rcode || 0;
+                    value += " (" + (rcodes[rcode] || "rcode " + rcode) + ", " + (this.data[i].Answers || 0) + " answers)";
+                }
+                if (this.data[i].HardwareAddr) {
+                    value += " (" + this.data[i].HardwareAddr + ")";
+                }
+                this.activeValueEl.innerHTML = d3.timeFormat('%a %b %Y %H:%M:%S')(this.data[i].Time) + "\n" + value;
             },
 
             mouseover: function(d, i) {
@@ -282,12 +347,61 @@ $(function() {
                         peers[i].history = -8.64e+7;
                         peers[i].AverageResponseTime = undefined;
                         peers[i].Uptime = undefined;
+                        peers[i].Events = [];
+                        peers[i].InvalidReplies = 0;
+                        peers[i].Outcomes = {};
+                        peers[i].ForwardLoss = 0;
+                        peers[i].BackwardLoss = 0;
+                        peers[i].Reordered = 0;
+                        peers[i].Loss = 0;
+                        peers[i].Jitter = 0;
+                        peers[i].InterarrivalJitter = 0;
+                        peers[i].Duplicates = 0;
+                        peers[i].MOS = 0;
+                        peers[i].RFactor = 0;
+                        peers[i].PathMTU = undefined;
+                        peers[i].Hops = [];
+                        peers[i].Clock = undefined;
+                        $.getJSON("/events?peer=" + peers[i].ID, (function(id){
+                            return function(events) {
+                                for (var i = $this.peers.length - 1; i >= 0; i--) {
+                                    if ($this.peers[i].ID === id) {
+                                        $this.peers[i].Events = events;
+                                        break;
+                                    }
+                                }
+                            }
+                        })(peers[i].ID));
+                        if (peers[i].Type === "mtu") {
+                            $.getJSON("/mtu?peer=" + peers[i].ID, (function(id){
+                                return function(pathMTUs) {
+                                    for (var i = $this.peers.length - 1; i >= 0; i--) {
+                                        if ($this.peers[i].ID === id && pathMTUs.length > 0) {
+                                            $this.peers[i].PathMTU = pathMTUs[pathMTUs.length - 1].MTU;
+                                            break;
+                                        }
+                                    }
+                                }
+                            })(peers[i].ID));
+                            continue;
+                        }
                         $.getJSON("/stats?peer=" + peers[i].ID, (function(id){
                             return function(stats) {
                                 for (var i = $this.peers.length - 1; i >= 0; i--) {
                                     if ($this.peers[i].ID === id) {
                                         $this.peers[i].AverageResponseTime = stats.AverageResponseTime.toFixed(1);
                                         $this.peers[i].Uptime = stats.Uptime.toFixed(1);
+                                        $this.peers[i].InvalidReplies = stats.InvalidReplies;
+                                        $this.peers[i].Outcomes = stats.Outcomes;
+                                        $this.peers[i].ForwardLoss = (stats.ForwardLoss || 0).toFixed(1);
+                                        $this.peers[i].BackwardLoss = (stats.BackwardLoss || 0).toFixed(1);
+                                        $this.peers[i].Reordered = stats.Reordered || 0;
+                                        $this.peers[i].Loss = (stats.Loss || 0).toFixed(1);
+                                        $this.peers[i].Jitter = (stats.Jitter || 0).toFixed(1);
+                                        $this.peers[i].InterarrivalJitter = (stats.InterarrivalJitter || 0).toFixed(1);
+                                        $this.peers[i].Duplicates = stats.Duplicates || 0;
+                                        $this.peers[i].MOS = (stats.MOS || 0).toFixed(1);
+                                        $this.peers[i].RFactor = (stats.RFactor || 0).toFixed(0);
                                         break;
                                     }
                                 }
@@ -295,6 +409,20 @@ $(function() {
                         })(peers[i].ID));
                     }
                     $this.peers = peers;
+                    $this.peers.forEach(function(peer) {
+                        if (peer.MaxHops > 0) {
+                            $this.loadHops(peer);
+                            setInterval(function() {
+                                $this.loadHops(peer);
+                            }, 10000);
+                        }
+                        if (peer.Timestamps) {
+                            $this.loadClock(peer);
+                            setInterval(function() {
+                                $this.loadClock(peer);
+                            }, 10000);
+                        }
+                    });
                 });
             } else {
                 this.peers = [
@@ -306,9 +434,55 @@ $(function() {
                         AverageResponseTime: 38.5,
                         Uptime: 99.9,
                         Interval: 1000,
+                        Events: [],
                     }
                 ]
             }
+        },
+        methods: {
+            formatTime: function(time) {
+                return d3.timeFormat('%a %b %Y %H:%M:%S')(time);
+            },
+            formatResponseTime: function(time) {
+                return time < 0 ? "-" : time.toFixed(1) + "ms";
+            },
+            formatMilliseconds: function(ms) {
+                return ms.toFixed(1) + "ms";
+            },
+            // loadHops gets the hop table of the last 10 minutes
+            loadHops: function(peer) {
+                var stop = new Date().getTime();
+                $.getJSON("/hops?peer=" + peer.ID + "&start=" + (stop - 6e+5) + "&stop=" + stop, function(hops) {
+                    peer.Hops = hops;
+                });
+            },
+            // loadClock gets the last clock sample of the last 10 minutes
+            loadClock: function(peer) {
+                var stop = new Date().getTime();
+                $.getJSON("/clock?peer=" + peer.ID + "&start=" + (stop - 6e+5) + "&stop=" + stop, function(samples) {
+                    if (samples.length > 0) {
+                        peer.Clock = samples[samples.length - 1];
+                    }
+                });
+            },
+            eventText: function(event) {
+                switch (event.Type) {
+                    case "address":
+                        return "Address changed from " + event.Old + " to " + event.New;
+                    case "mtu":
+                        return "Path MTU shrunk from " + event.Old + " to " + event.New;
+                    case "hops":
+                        return "Hop count changed from " + event.Old + " to " + event.New;
+                    case "route":
+                        return "Route changed from " + event.Old.split(" ").join(" → ") + " to " + event.New.split(" ").join(" → ");
+                    case "mos":
+                        if (event.Old && parseFloat(event.New) > parseFloat(event.Old)) {
+                            return "Call quality recovered from " + event.Old + " to " + event.New + "/5";
+                        }
+                        return "Call quality dropped " + (event.Old ? "from " + event.Old + " " : "") + "to " + event.New + "/5";
+                }
+                return event.Type + ": " + event.Old + " → " + event.New;
+            }
         }
     });
 });
\ No newline at end of file
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	// arpRequest and arpReply are the operations of ARP messages (RFC 826)
+	arpRequest = 1
+	arpReply   = 2
+	// arpMessageLength is the length of an ARP message for IPv4 over ethernet
+	arpMessageLength = 28
+)
+
+// htons returns v in network byte order
+func htons(v uint16) uint16 {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], v)
+	return *(*uint16)(unsafe.Pointer(&b[0]))
+}
+
+// probeARP asks for the hardware address of the peer on its interface in the background,
+// with an ARP request for IPv4 and a neighbor solicitation for IPv6.
+// The time until the answer arrived gets sent to the collector.
+func probeARP(peer *Peer) error {
+	ip := peer.IP()
+	if ip == nil {
+		// hostname was not resolved yet
+		return nil
+	}
+	ipVersion := 6
+	if ip.To4() != nil {
+		ipVersion = 4
+	}
+	source, ifaceName := peerSource(peer, ipVersion)
+	if ifaceName == "" {
+		return errors.New("an Interface is needed")
+	}
+
+	go func() {
+		var conn *os.File
+		var iface *net.Interface
+		var request []byte
+		var destination syscall.Sockaddr
+		// the interface and its addresses have to be looked up in the namespace as well
+		err := inNamespace(peer.namespace(), func() (err error) {
+			iface, err = net.InterfaceByName(ifaceName)
+			if err != nil {
+				return err
+			}
+			if ipVersion == 4 {
+				conn, request, destination, err = arpSocket(iface, net.ParseIP(source), ip)
+			} else {
+				conn, request, destination, err = ndpSocket(iface, ip)
+			}
+			return err
+		})
+		if err != nil {
+			log.Printf("Unable to ping %s: %v\n", *peer.Name, err)
+			return
+		}
+		defer conn.Close()
+
+		timeout := time.Duration(*peer.Timeout) * time.Millisecond
+		sent := time.Now()
+		conn.SetReadDeadline(sent.Add(timeout))
+		query := Query{
+			PeerID:       *peer.ID,
+			ResponseTime: -1,
+			Outcome:      OutcomeOK,
+		}
+		var hardwareAddr net.HardwareAddr
+		if err = sendPacket(conn, request, destination); err == nil {
+			if ipVersion == 4 {
+				hardwareAddr, err = readARPReply(conn, ip)
+			} else {
+				hardwareAddr, err = readNeighborAdvertisement(conn, ip)
+			}
+		}
+		received := time.Now()
+		query.Time = received.UTC().UnixNano() / 1000000
+		if err != nil {
+			query.Outcome = dialOutcome(err)
+			log.Printf("Got %s for %s (%v)\n", query.Outcome, *peer.Name, err)
+		} else {
+			query.ResponseTime = float64(received.Sub(sent)) / float64(time.Millisecond)
+			query.HardwareAddr = hardwareAddr.String()
+		}
+		messages.In() <- query
+	}()
+	return nil
+}
+
+// arpSocket opens a packet socket for ARP messages on iface and returns the ARP request for ip,
+// source is the sender address of the request, by default the one of iface in the network of ip
+func arpSocket(iface *net.Interface, source net.IP, ip net.IP) (*os.File, []byte, syscall.Sockaddr, error) {
+	if source == nil || source.IsUnspecified() {
+		source = interfaceAddress(iface, ip)
+	}
+	request := arpRequestMessage(iface.HardwareAddr, source, ip)
+
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_DGRAM|syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC, int(htons(syscall.ETH_P_ARP)))
+	if err != nil {
+		return nil, nil, nil, os.NewSyscallError("socket", err)
+	}
+	err = syscall.Bind(fd, &syscall.SockaddrLinklayer{Protocol: htons(syscall.ETH_P_ARP), Ifindex: iface.Index})
+	if err != nil {
+		syscall.Close(fd)
+		return nil, nil, nil, os.NewSyscallError("bind", err)
+	}
+	broadcast := &syscall.SockaddrLinklayer{Protocol: htons(syscall.ETH_P_ARP), Ifindex: iface.Index, Halen: 6}
+	copy(broadcast.Addr[:], []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	return os.NewFile(uintptr(fd), "arp:"+iface.Name), request, broadcast, nil
+}
+
+// interfaceAddress returns the IPv4 address of iface in the network of ip, the first one if none is,
+// it is 0.0.0.0 if iface has none, which makes the request an ARP probe (RFC 5227)
+func interfaceAddress(iface *net.Interface, ip net.IP) net.IP {
+	addrs, _ := iface.Addrs()
+	var first net.IP
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.To4() == nil {
+			continue
+		}
+		if ipNet.Contains(ip) {
+			return ipNet.IP
+		}
+		if first == nil {
+			first = ipNet.IP
+		}
+	}
+	if first == nil {
+		return net.IPv4zero
+	}
+	return first
+}
+
+// arpRequestMessage returns the ARP request for ip from the host with hardwareAddr and source
+func arpRequestMessage(hardwareAddr net.HardwareAddr, source net.IP, ip net.IP) []byte {
+	request := make([]byte, arpMessageLength)
+	// ethernet, IPv4, the lengths of their addresses and the operation
+	binary.BigEndian.PutUint16(request[0:], 1)
+	binary.BigEndian.PutUint16(request[2:], syscall.ETH_P_IP)
+	request[4], request[5] = 6, 4
+	binary.BigEndian.PutUint16(request[6:], arpRequest)
+	copy(request[8:14], hardwareAddr)
+	copy(request[14:18], source.To4())
+	copy(request[24:28], ip.To4())
+	return request
+}
+
+// parseARPReply returns the hardware address of ip in the ARP message b,
+// ok is false if b is not the reply of ip
+func parseARPReply(b []byte, ip net.IP) (hardwareAddr net.HardwareAddr, ok bool) {
+	// e.g. the requests of other hosts
+	if len(b) < arpMessageLength || binary.BigEndian.Uint16(b[2:]) != syscall.ETH_P_IP || b[4] != 6 || b[5] != 4 ||
+		binary.BigEndian.Uint16(b[6:]) != arpReply || !net.IP(b[14:18]).Equal(ip.To4()) {
+		return nil, false
+	}
+	return net.HardwareAddr(append([]byte(nil), b[8:14]...)), true
+}
+
+// readARPReply waits for the ARP reply of ip and returns the hardware address it has
+func readARPReply(conn *os.File, ip net.IP) (net.HardwareAddr, error) {
+	b := make([]byte, 1500)
+	for {
+		n, err := conn.Read(b)
+		if err != nil {
+			return nil, err
+		}
+		if hardwareAddr, ok := parseARPReply(b[:n], ip); ok {
+			return hardwareAddr, nil
+		}
+	}
+}
+
+// ndpSocket opens an ICMPv6 socket on iface and returns the neighbor solicitation for ip (RFC 4861)
+// and the solicited-node multicast address it has to be sent to
+func ndpSocket(iface *net.Interface, ip net.IP) (*os.File, []byte, syscall.Sockaddr, error) {
+	request, err := neighborSolicitation(iface.HardwareAddr, ip)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	fd, err := syscall.Socket(syscall.AF_INET6, syscall.SOCK_RAW|syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC, ProtocolIPv6ICMP)
+	if err != nil {
+		return nil, nil, nil, os.NewSyscallError("socket", err)
+	}
+	// neighbor discovery messages with another hop limit get dropped
+	for _, option := range []int{syscall.IPV6_UNICAST_HOPS, syscall.IPV6_MULTICAST_HOPS} {
+		if err = syscall.SetsockoptInt(fd, syscall.SOL_IPV6, option, 255); err != nil {
+			syscall.Close(fd)
+			return nil, nil, nil, os.NewSyscallError("setsockopt", err)
+		}
+	}
+	if err = syscall.SetsockoptString(fd, syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, iface.Name); err != nil {
+		syscall.Close(fd)
+		return nil, nil, nil, os.NewSyscallError("setsockopt", err)
+	}
+	solicitedNode := &syscall.SockaddrInet6{ZoneId: uint32(iface.Index)}
+	copy(solicitedNode.Addr[:], solicitedNodeAddress(ip))
+	return os.NewFile(uintptr(fd), "ndp:"+iface.Name), request, solicitedNode, nil
+}
+
+// neighborSolicitation returns the neighbor solicitation for ip from the host with hardwareAddr
+func neighborSolicitation(hardwareAddr net.HardwareAddr, ip net.IP) ([]byte, error) {
+	body := make([]byte, 4, 4+16+8)
+	body = append(body, ip.To16()...)
+	// the source link-layer address option, so the peer does not need to solicit it
+	body = append(body, 1, 1)
+	body = append(body, hardwareAddr...)
+	message := icmp.Message{
+		Type: ipv6.ICMPTypeNeighborSolicitation,
+		Body: &icmp.RawBody{Data: body},
+	}
+	// the kernel calculates the checksum of ICMPv6 messages
+	return message.Marshal(nil)
+}
+
+// solicitedNodeAddress returns the multicast address the neighbor solicitations for ip get sent to,
+// ff02::1:ff00:0/104 and the last 24 bits of ip
+func solicitedNodeAddress(ip net.IP) net.IP {
+	address := net.ParseIP("ff02::1:ff00:0")
+	copy(address[13:], ip.To16()[13:])
+	return address
+}
+
+// parseNeighborAdvertisement returns the hardware address of ip in the ICMPv6 message b,
+// ok is false if b is not the neighbor advertisement of ip. The hardware address is nil
+// if the advertisement has no target link-layer address option.
+func parseNeighborAdvertisement(b []byte, ip net.IP) (hardwareAddr net.HardwareAddr, ok bool) {
+	// e.g. the echo requests of other hosts
+	if len(b) < 24 || b[0] != byte(ipv6.ICMPTypeNeighborAdvertisement) || !bytes.Equal(b[8:24], ip.To16()) {
+		return nil, false
+	}
+	// the options are a type, their length in units of 8 bytes and the data
+	for options := b[24:]; len(options) >= 8 && options[1] > 0 && int(options[1])*8 <= len(options); options = options[int(options[1])*8:] {
+		if options[0] == 2 {
+			return net.HardwareAddr(append([]byte(nil), options[2:8]...)), true
+		}
+	}
+	return nil, true
+}
+
+// readNeighborAdvertisement waits for the neighbor advertisement of ip
+// and returns the hardware address it has
+func readNeighborAdvertisement(conn *os.File, ip net.IP) (net.HardwareAddr, error) {
+	b := make([]byte, 1500)
+	for {
+		n, err := conn.Read(b)
+		if err != nil {
+			return nil, err
+		}
+		if hardwareAddr, ok := parseNeighborAdvertisement(b[:n], ip); ok {
+			return hardwareAddr, nil
+		}
+	}
+}
+
+// sendPacket sends b from the socket of conn to destination
+func sendPacket(conn *os.File, b []byte, destination syscall.Sockaddr) error {
+	c, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	cerr := c.Write(func(fd uintptr) bool {
+		err = syscall.Sendto(int(fd), b, 0, destination)
+		return err != syscall.EAGAIN
+	})
+	if cerr != nil {
+		return cerr
+	}
+	if err != nil {
+		return fmt.Errorf("unable to send to %s: %v", conn.Name(), os.NewSyscallError("sendto", err))
+	}
+	return nil
+}
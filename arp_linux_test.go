@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	testHardwareAddr = net.HardwareAddr{0x02, 0x00, 0x5e, 0x10, 0x00, 0x01}
+	testPeerAddr     = net.HardwareAddr{0x02, 0x00, 0x5e, 0x10, 0x00, 0x02}
+)
+
+// testARPMessage returns an ARP message of ethernet and IPv4 with the operation
+func testARPMessage(operation byte, senderAddr net.HardwareAddr, senderIP string, targetIP string) []byte {
+	b := []byte{0, 1, 8, 0, 6, 4, 0, operation}
+	b = append(b, senderAddr...)
+	b = append(b, net.ParseIP(senderIP).To4()...)
+	b = append(b, make([]byte, 6)...)
+	return append(b, net.ParseIP(targetIP).To4()...)
+}
+
+func TestARPRequestMessage(t *testing.T) {
+	got := arpRequestMessage(testHardwareAddr, net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2"))
+	want := testARPMessage(arpRequest, testHardwareAddr, "192.0.2.1", "192.0.2.2")
+	if !bytes.Equal(got, want) {
+		t.Fatalf("got % x, want % x", got, want)
+	}
+}
+
+func TestParseARPReply(t *testing.T) {
+	reply := testARPMessage(arpReply, testPeerAddr, "192.0.2.2", "192.0.2.1")
+	ipv6Reply := append([]byte(nil), reply...)
+	ipv6Reply[2] = 0x86
+	tests := []struct {
+		name    string
+		message []byte
+		ok      bool
+	}{
+		{"reply", reply, true},
+		// the ethernet frame of a reply gets padded to 60 bytes
+		{"padded reply", append(append([]byte(nil), reply...), make([]byte, 18)...), true},
+		{"request", testARPMessage(arpRequest, testPeerAddr, "192.0.2.2", "192.0.2.1"), false},
+		{"reply of another host", testARPMessage(arpReply, testPeerAddr, "192.0.2.3", "192.0.2.1"), false},
+		{"other protocol", ipv6Reply, false},
+		{"short", reply[:arpMessageLength-1], false},
+	}
+	for _, test := range tests {
+		hardwareAddr, ok := parseARPReply(test.message, net.ParseIP("192.0.2.2"))
+		if ok != test.ok || (ok && hardwareAddr.String() != testPeerAddr.String()) {
+			t.Errorf("%s: got %s, %v", test.name, hardwareAddr, ok)
+		}
+	}
+}
+
+func TestNeighborSolicitation(t *testing.T) {
+	ip := net.ParseIP("2001:db8::1:2345:6789")
+	got, err := neighborSolicitation(testHardwareAddr, ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the type, the code, the checksum the kernel fills in, reserved bytes,
+	// the target and the source link-layer address option
+	want := append([]byte{135, 0, 0, 0, 0, 0, 0, 0}, ip...)
+	want = append(append(want, 1, 1), testHardwareAddr...)
+	if !bytes.Equal(got, want) {
+		t.Fatalf("got % x, want % x", got, want)
+	}
+	if address := solicitedNodeAddress(ip); !address.Equal(net.ParseIP("ff02::1:ff45:6789")) {
+		t.Fatalf("got the solicited-node address %s", address)
+	}
+}
+
+func TestParseNeighborAdvertisement(t *testing.T) {
+	ip := net.ParseIP("2001:db8::2")
+	advertisement := func(messageType byte, target string, options ...byte) []byte {
+		b := append([]byte{messageType, 0, 0, 0, 0x60, 0, 0, 0}, net.ParseIP(target)...)
+		return append(b, options...)
+	}
+	targetOption := append([]byte{2, 1}, testPeerAddr...)
+	nonceOption := []byte{14, 1, 1, 2, 3, 4, 5, 6}
+	tests := []struct {
+		name         string
+		message      []byte
+		hardwareAddr net.HardwareAddr
+		ok           bool
+	}{
+		{"target link-layer address", advertisement(136, "2001:db8::2", targetOption...), testPeerAddr, true},
+		{"after another option", advertisement(136, "2001:db8::2", append(nonceOption, targetOption...)...), testPeerAddr, true},
+		{"without options", advertisement(136, "2001:db8::2"), nil, true},
+		{"option of length 0", advertisement(136, "2001:db8::2", 2, 0, 1, 2, 3, 4, 5, 6), nil, true},
+		{"option longer than the message", advertisement(136, "2001:db8::2", 2, 2, 1, 2, 3, 4, 5, 6), nil, true},
+		{"another target", advertisement(136, "2001:db8::3", targetOption...), nil, false},
+		{"solicitation", advertisement(135, "2001:db8::2", targetOption...), nil, false},
+		{"short", advertisement(136, "2001:db8::2")[:23], nil, false},
+	}
+	for _, test := range tests {
+		hardwareAddr, ok := parseNeighborAdvertisement(test.message, ip)
+		if ok != test.ok || hardwareAddr.String() != test.hardwareAddr.String() {
+			t.Errorf("%s: got %s, %v", test.name, hardwareAddr, ok)
+		}
+	}
+}
+
+// run runs the command and fails the test if it does not succeed
+func run(t *testing.T, command string) {
+	t.Helper()
+	args := strings.Fields(command)
+	if output, err := exec.Command(args[0], args[1:]...).CombinedOutput(); err != nil {
+		t.Fatalf("%s: %v: %s", command, err, output)
+	}
+}
+
+// TestProbeARP probes the other end of a veth pair in a network namespace
+func TestProbeARP(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("needs root to create a network namespace")
+	}
+	if _, err := exec.LookPath("ip"); err != nil {
+		t.Skip("needs ip to create a network namespace")
+	}
+	const namespace = "icmpmon-arp-test"
+	exec.Command("ip", "netns", "del", namespace).Run()
+	run(t, "ip netns add "+namespace)
+	defer exec.Command("ip", "netns", "del", namespace).Run()
+	run(t, "ip link add imt0 address "+testHardwareAddr.String()+" type veth peer name imt1 address "+testPeerAddr.String()+" netns "+namespace)
+	defer exec.Command("ip", "link", "del", "imt0").Run()
+	run(t, "ip addr add 10.213.0.1/24 dev imt0")
+	run(t, "ip addr add fd13::1/64 dev imt0 nodad")
+	run(t, "ip link set imt0 up")
+	run(t, "ip -n "+namespace+" addr add 10.213.0.2/24 dev imt1")
+	run(t, "ip -n "+namespace+" addr add fd13::2/64 dev imt1 nodad")
+	run(t, "ip -n "+namespace+" link set imt1 up")
+
+	tests := []struct {
+		name         string
+		peer         string
+		outcome      string
+		hardwareAddr net.HardwareAddr
+	}{
+		{"ipv4", "Address: 10.213.0.2\nInterface: imt0", OutcomeOK, testPeerAddr},
+		{"ipv6", "Address: \"fd13::2\"\nInterface: imt0", OutcomeOK, testPeerAddr},
+		{"namespace", "Address: 10.213.0.1\nInterface: imt1\nNamespace: " + namespace, OutcomeOK, testHardwareAddr},
+		{"absent", "Address: 10.213.0.3\nInterface: imt0", OutcomeTimeout, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			peers := useTestConfig(t, "{\nPeers: [\n{\nType: arp\nTimeout: 500\n"+test.peer+"\n}\n]\n}")
+			var query Query
+			// the link-local address of the interface needs a moment to get usable after the link came up
+			for attempt := 0; attempt < 5; attempt++ {
+				if query = probeTestPeer(t, &peers[0], probeARP); query.Outcome == test.outcome {
+					break
+				}
+				time.Sleep(500 * time.Millisecond)
+			}
+			if query.Outcome != test.outcome || query.HardwareAddr != test.hardwareAddr.String() {
+				t.Fatalf("got %s with %q, want %s with %q", query.Outcome, query.HardwareAddr, test.outcome, test.hardwareAddr)
+			}
+			if (query.ResponseTime >= 0) != (test.outcome == OutcomeOK) {
+				t.Fatalf("got the response time %f for %s", query.ResponseTime, query.Outcome)
+			}
+		})
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+)
+
+// probeARP needs packet sockets, they are only supported on linux
+func probeARP(peer *Peer) error {
+	return errors.New("arp peers are only supported on linux")
+}
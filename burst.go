@@ -0,0 +1,101 @@
+package main
+
+import (
+	"log"
+	"math"
+	"net"
+	"time"
+)
+
+// burst sends Count echo requests Spacing Milliseconds apart to ip of the peer
+// and sends one query with the aggregate of their replies to the collector
+func burst(peer *Peer, ip net.IP, listener *Listener) {
+	spacing := time.Duration(*peer.Spacing) * time.Millisecond
+	results := make([]chan Query, *peer.Count)
+	for i := range results {
+		if i > 0 {
+			time.Sleep(spacing)
+		}
+		results[i] = make(chan Query, 1)
+		if err := sendEcho(peer, ip, listener, *peer.Size, 0, results[i]); err != nil {
+			log.Printf("Unable to ping %s: %v\n", *peer.Name, err)
+			results[i] = nil
+		}
+	}
+
+	// the collector times out every request, this only guards against lost results
+	deadline := time.Now().Add(time.Duration(*peer.Timeout)*time.Millisecond + 2*time.Second)
+	queries := make([]Query, len(results))
+	for i, result := range results {
+		queries[i] = Query{ResponseTime: -1, Outcome: OutcomeTimeout}
+		if result == nil {
+			continue
+		}
+		select {
+		case queries[i] = <-result:
+		case <-time.After(time.Until(deadline)):
+		}
+	}
+	query := aggregate(queries)
+	query.PeerID = *peer.ID
+	query.Time = time.Now().UTC().UnixNano() / 1000000
+	if query.ResponseTime < 0 {
+		log.Printf("Got %s for all %d echo requests to %s\n", query.Outcome, query.Sent, *peer.Name)
+	}
+	messages.In() <- query
+}
+
+// aggregate returns the query of a burst the way SmokePing sums it up, the ResponseTime
+// is the average of the replies and -1 if there was none, then the Outcome is the one of
+// the first request
+func aggregate(queries []Query) Query {
+	query := Query{
+		ResponseTime: -1,
+		Outcome:      OutcomeOK,
+		Sent:         len(queries),
+	}
+	var times []float64
+	for _, q := range queries {
+		switch q.Outcome {
+		case OutcomeOK, OutcomeCorrupted:
+			times = append(times, q.ResponseTime)
+			if q.Outcome == OutcomeCorrupted {
+				query.Outcome = OutcomeCorrupted
+			}
+			if q.TTL > 0 {
+				query.TTL = q.TTL
+			}
+		}
+	}
+	if len(times) == 0 {
+		if len(queries) > 0 {
+			query.Outcome = queries[0].Outcome
+			query.Code = queries[0].Code
+			query.Reporter = queries[0].Reporter
+			query.MTU = queries[0].MTU
+			query.Loss = 100
+		}
+		return query
+	}
+	query.Loss = float64(len(queries)-len(times)) * 100 / float64(len(queries))
+
+	var sum float64
+	query.MinResponseTime = times[0]
+	query.MaxResponseTime = times[0]
+	for i, t := range times {
+		sum += t
+		query.MinResponseTime = math.Min(query.MinResponseTime, t)
+		query.MaxResponseTime = math.Max(query.MaxResponseTime, t)
+		// the mean difference of successive replies
+		if i > 0 {
+			query.Jitter += math.Abs(t-times[i-1]) / float64(len(times)-1)
+		}
+	}
+	query.ResponseTime = sum / float64(len(times))
+	var variance float64
+	for _, t := range times {
+		variance += (t - query.ResponseTime) * (t - query.ResponseTime) / float64(len(times))
+	}
+	query.StdDev = math.Sqrt(variance)
+	return query
+}
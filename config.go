@@ -1,35 +1,142 @@
 package main
 
 import (
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net"
+	"net/url"
+	"regexp"
 	"time"
 
 	"strconv"
 	"strings"
+	"sync"
 
 	"hash/crc32"
 
 	hjson "github.com/hjson/hjson-go"
+	"golang.org/x/net/dns/dnsmessage"
 )
 
+const (
+	// PeerTypeICMP pings the peer with echo requests
+	PeerTypeICMP = "icmp"
+	// PeerTypeMTU discovers the path MTU to the peer with echo requests that have the DF bit set
+	PeerTypeMTU = "mtu"
+	// PeerTypeTCP connects to Port of the peer and measures the time of the handshake
+	PeerTypeTCP = "tcp"
+	// PeerTypeHTTP fetches the URL in Address and measures the time of every phase of the request
+	PeerTypeHTTP = "http"
+	// PeerTypeDNS sends QueryName to the name server at Address and measures the time until the response
+	PeerTypeDNS = "dns"
+	// PeerTypeUDP sends TWAMP light test packets to the reflector at Address,
+	// e.g. another icmpmon that runs "icmpmon reflect"
+	PeerTypeUDP = "udp"
+	// PeerTypeARP asks the on-link peer for its MAC address on Interface and measures the time
+	// until the answer, with ARP for IPv4 and neighbor discovery for IPv6 (linux only)
+	PeerTypeARP = "arp"
+)
+
+// peerTypes are all valid types of a peer
+var peerTypes = []string{PeerTypeICMP, PeerTypeMTU, PeerTypeTCP, PeerTypeHTTP, PeerTypeDNS, PeerTypeUDP, PeerTypeARP}
+
 type Peer struct {
-	Name     *string
-	Address  *string
+	Name    *string
+	Address *string
+	// Type is how the peer gets monitored, see PeerTypeICMP
+	Type     *string
 	Interval *int
 	Timeout  *int
-	ID       *int64
-	ip       net.IP
+	// ResolveInterval is the interval in Milliseconds in which the Address
+	// gets resolved again if it is a hostname
+	ResolveInterval *int
+	// Source and Interface select the path the peer is pinged through,
+	// they default to SourceIPv4/SourceIPv6 and Interface of the Config
+	Source    *string
+	Interface *string
+	// Size is the number of data bytes every echo request carries,
+	// at least EchoPayloadLength
+	Size *int
+	// Pattern are the hex encoded bytes the data after the first EchoPayloadLength
+	// bytes is filled with, by default the bytes count up
+	Pattern *string
+	// DontFragment sets the DF bit, echo requests that are too big for
+	// the path get a packet too big outcome instead of being fragmented
+	DontFragment bool
+	// Port is the port PeerTypeTCP connects to, PeerTypeDNS and PeerTypeUDP
+	// use DNSPort and TWAMPPort if it is not set
+	Port *int
+	// Status is the status code PeerTypeHTTP expects, by default every 2xx and 3xx code is fine
+	Status *int
+	// Match is a regular expression the body of a PeerTypeHTTP response has to match
+	Match *string
+	// QueryName and QueryType are the name and the record type PeerTypeDNS asks for,
+	// QueryType defaults to A
+	QueryName *string
+	QueryType *string
+	// Protocol is the transport PeerTypeDNS sends its queries with, see DNSProtocolUDP
+	Protocol *string
+	// FailOnRcode counts SERVFAIL and NXDOMAIN responses of PeerTypeDNS as failures
+	FailOnRcode bool
+	// MaxMTU is the largest path MTU PeerTypeMTU looks for
+	MaxMTU *int
+	// MaxHops enables the hop mode if it is set, every Interval an echo request
+	// gets sent with every TTL up to MaxHops to get the time and loss to each hop
+	MaxHops *int
+	// RouteInterval enables route snapshots if it is set, every RouteInterval Milliseconds
+	// the hops to the peer get compared with the last snapshot
+	RouteInterval *int
+	// Count is the number of echo requests that get sent Spacing Milliseconds apart every Interval,
+	// their replies are summed up in one query, the burst has to be over by the next Interval
+	Count   *int
+	Spacing *int
+	// Timestamps sends an ICMP timestamp request with every echo request to get the delay
+	// of each direction and the offset of the clock of the peer (IPv4 and raw sockets only)
+	Timestamps bool
+	// MinMOS records an event whenever the MOS of a sample falls below it or recovers,
+	// only peers of the types PeerTypeICMP and PeerTypeUDP get a MOS
+	MinMOS *float64
+	// DSCP is the DSCP value (0 to 63) echo requests and the test packets of PeerTypeUDP
+	// are marked with, a list of values probes the peer with each of them as a series of its own
+	DSCP       *int
+	dscpSeries bool
+	// Namespace is the network namespace (linux only) the peer is probed from,
+	// it defaults to Namespace of the Config
+	Namespace *string
+	ID        *int64
+	ip        net.IP
+	pattern   []byte
+	match     *regexp.Regexp
+	question  dnsmessage.Question
+	// seq is the sequence number of the last echo request sent to the peer
+	seq int
 }
 type Config struct {
-	Peers          []Peer
-	Interval       *int
-	Timeout        *int
-	ListenAddress  *string
-	DataBase       *string
-	KeepHistoryFor time.Duration
+	Peers           []Peer
+	Interval        *int
+	Timeout         *int
+	ResolveInterval *int
+	// ICMPMode is the type of socket used to ping, see ICMPModeAuto
+	ICMPMode *string
+	// SourceIPv4 and SourceIPv6 are the addresses the ICMP sockets are bound to
+	SourceIPv4 *string
+	SourceIPv6 *string
+	// Interface is the network interface the ICMP sockets are bound to (linux only)
+	Interface *string
+	// Namespace is the network namespace the sockets are opened in (linux only),
+	// the name of one in /var/run/netns or the path of one, e.g. /proc/1/ns/net
+	Namespace *string
+	// KernelTimestamps uses the time the kernel received a reply at (linux only)
+	KernelTimestamps bool
+	// PacketsPerSecond is the most packets the scheduler sends per second, 0 for no limit
+	PacketsPerSecond *int
+	ListenAddress    *string
+	DataBase         *string
+	KeepHistoryFor   time.Duration
+	// peersByID holds the Peers by their id
+	peersByID map[int64]*Peer
 }
 
 func readInt(amap map[string]interface{}, name string) (*int, error) {
@@ -72,17 +179,90 @@ func readInt(amap map[string]interface{}, name string) (*int, error) {
 	return nil, errors.New("not found")
 }
 
+func readFloat(amap map[string]interface{}, name string) (*float64, error) {
+	for key, value := range amap {
+		if strings.EqualFold(key, name) {
+			switch value.(type) {
+			case int:
+				ret := new(float64)
+				*ret = float64(value.(int))
+				return ret, nil
+			case int64:
+				ret := new(float64)
+				*ret = float64(value.(int64))
+				return ret, nil
+			case string:
+				var err error
+				ret := new(float64)
+				*ret, err = strconv.ParseFloat(value.(string), 64)
+				return ret, err
+			case float32:
+				ret := new(float64)
+				*ret = float64(value.(float32))
+				return ret, nil
+			case float64:
+				ret := new(float64)
+				*ret = value.(float64)
+				return ret, nil
+			}
+			return nil, errors.New("invalid format")
+		}
+	}
+	return nil, errors.New("not found")
+}
+
+// dscpNames are the names of the DSCP values of the class selector, assured forwarding
+// and expedited forwarding per hop behaviors
+var dscpNames = map[string]int{
+	"CS0": 0, "CS1": 8, "CS2": 16, "CS3": 24, "CS4": 32, "CS5": 40, "CS6": 48, "CS7": 56,
+	"AF11": 10, "AF12": 12, "AF13": 14, "AF21": 18, "AF22": 20, "AF23": 22,
+	"AF31": 26, "AF32": 28, "AF33": 30, "AF41": 34, "AF42": 36, "AF43": 38,
+	"EF": 46,
+}
+
+// readDSCPs returns the DSCP values of a peer, a single value or a list of numbers and names,
+// the only value is nil if none is set
+func readDSCPs(amap map[string]interface{}, name string) ([]*int, error) {
+	var values []interface{}
+	for key, value := range amap {
+		if strings.EqualFold(key, name) {
+			if list, ok := value.([]interface{}); ok {
+				values = list
+			} else {
+				values = []interface{}{value}
+			}
+		}
+	}
+	if len(values) == 0 {
+		return []*int{nil}, nil
+	}
+	var dscps []*int
+	for _, value := range values {
+		dscp, err := readInt(map[string]interface{}{name: value}, name)
+		if str, ok := value.(string); ok {
+			if d, ok := dscpNames[strings.ToUpper(str)]; ok {
+				dscp, err = &d, nil
+			}
+		}
+		if err != nil || *dscp < 0 || *dscp > 63 {
+			return nil, fmt.Errorf("'%v' is not a valid DSCP value", value)
+		}
+		dscps = append(dscps, dscp)
+	}
+	return dscps, nil
+}
+
 func readString(amap map[string]interface{}, name string) (*string, error) {
 	for key, value := range amap {
 		if strings.EqualFold(key, name) {
 			switch value.(type) {
 			case int:
 				ret := new(string)
-				*ret = string(value.(int))
+				*ret = strconv.Itoa(value.(int))
 				return ret, nil
 			case int64:
 				ret := new(string)
-				*ret = string(value.(int64))
+				*ret = strconv.FormatInt(value.(int64), 10)
 				return ret, nil
 			case string:
 				ret := new(string)
@@ -127,28 +307,68 @@ func readPeers(amap map[string]interface{}, name string) (peers []Peer, err erro
 						*str = value.(string)
 						peers = append(peers, Peer{Address: str})
 					case map[string]interface{}:
-						var peer Peer
-						var id *int
-						id, _ = readInt(value.(map[string]interface{}), "ID")
-						if id != nil {
-							peer.ID = new(int64)
-							*peer.ID = int64(*id)
-						}
-						peer.Interval, _ = readInt(value.(map[string]interface{}), "Interval")
-						peer.Timeout, _ = readInt(value.(map[string]interface{}), "Timeout")
-						peer.Address, err = readString(value.(map[string]interface{}), "Address")
+						// every DSCP value of the peer is a series of its own
+						dscps, err := readDSCPs(value.(map[string]interface{}), "DSCP")
 						if err != nil {
-							if err.Error() == "invalid format" {
-								return peers, errors.New("'Address' has an invalid format")
-							} else if err.Error() == "not found" {
-								return peers, errors.New("'Address' was not found")
-							}
+							return peers, err
+						}
+						if id, _ := readInt(value.(map[string]interface{}), "ID"); id != nil && len(dscps) > 1 {
+							return peers, errors.New("'ID' cannot be set with a list of DSCP values, every series needs an id of its own")
 						}
-						if peer.Address == nil || len(*peer.Address) <= 0 {
-							return peers, errors.New("'Address' is invalid")
+						for _, dscp := range dscps {
+							var peer Peer
+							var id *int
+							id, _ = readInt(value.(map[string]interface{}), "ID")
+							if id != nil {
+								peer.ID = new(int64)
+								*peer.ID = int64(*id)
+							}
+							peer.Interval, _ = readInt(value.(map[string]interface{}), "Interval")
+							peer.Timeout, _ = readInt(value.(map[string]interface{}), "Timeout")
+							peer.ResolveInterval, _ = readInt(value.(map[string]interface{}), "ResolveInterval")
+							peer.Address, err = readString(value.(map[string]interface{}), "Address")
+							if err != nil {
+								if err.Error() == "invalid format" {
+									return peers, errors.New("'Address' has an invalid format")
+								} else if err.Error() == "not found" {
+									return peers, errors.New("'Address' was not found")
+								}
+							}
+							if peer.Address == nil || len(*peer.Address) <= 0 {
+								return peers, errors.New("'Address' is invalid")
+							}
+							peer.Name, _ = readString(value.(map[string]interface{}), "Name")
+							peer.Type, _ = readString(value.(map[string]interface{}), "Type")
+							peer.MaxMTU, _ = readInt(value.(map[string]interface{}), "MaxMTU")
+							peer.Port, _ = readInt(value.(map[string]interface{}), "Port")
+							peer.Status, _ = readInt(value.(map[string]interface{}), "Status")
+							peer.Match, _ = readString(value.(map[string]interface{}), "Match")
+							peer.QueryName, _ = readString(value.(map[string]interface{}), "QueryName")
+							peer.QueryType, _ = readString(value.(map[string]interface{}), "QueryType")
+							peer.Protocol, _ = readString(value.(map[string]interface{}), "Protocol")
+							if timestamps, _ := readInt(value.(map[string]interface{}), "Timestamps"); timestamps != nil {
+								peer.Timestamps = *timestamps != 0
+							}
+							if failOnRcode, _ := readInt(value.(map[string]interface{}), "FailOnRcode"); failOnRcode != nil {
+								peer.FailOnRcode = *failOnRcode != 0
+							}
+							peer.MaxHops, _ = readInt(value.(map[string]interface{}), "MaxHops")
+							peer.RouteInterval, _ = readInt(value.(map[string]interface{}), "RouteInterval")
+							peer.Source, _ = readString(value.(map[string]interface{}), "Source")
+							peer.Interface, _ = readString(value.(map[string]interface{}), "Interface")
+							peer.Namespace, _ = readString(value.(map[string]interface{}), "Namespace")
+							peer.Size, _ = readInt(value.(map[string]interface{}), "Size")
+							peer.Count, _ = readInt(value.(map[string]interface{}), "Count")
+							peer.Spacing, _ = readInt(value.(map[string]interface{}), "Spacing")
+							peer.Pattern, _ = readString(value.(map[string]interface{}), "Pattern")
+							peer.MinMOS, _ = readFloat(value.(map[string]interface{}), "MinMOS")
+							if dontFragment, _ := readInt(value.(map[string]interface{}), "DontFragment"); dontFragment != nil {
+								peer.DontFragment = *dontFragment != 0
+							}
+							peer.DSCP = dscp
+							peer.dscpSeries = len(dscps) > 1
+							peers = append(peers, peer)
 						}
-						peer.Name, _ = readString(value.(map[string]interface{}), "Name")
-						peers = append(peers, peer)
 					}
 				}
 			}
@@ -179,6 +399,13 @@ func ReadConfig(configFile string) (config Config, err error) {
 		*config.Interval = 10
 	}
 
+	config.PacketsPerSecond, _ = readInt(dat, "PacketsPerSecond")
+	if config.PacketsPerSecond == nil {
+		config.PacketsPerSecond = new(int)
+	} else if *config.PacketsPerSecond < 0 {
+		*config.PacketsPerSecond = 0
+	}
+
 	config.Timeout, _ = readInt(dat, "Timeout")
 	if config.Timeout == nil {
 		config.Timeout = new(int)
@@ -187,6 +414,14 @@ func ReadConfig(configFile string) (config Config, err error) {
 		*config.Timeout = 10
 	}
 
+	config.ResolveInterval, _ = readInt(dat, "ResolveInterval")
+	if config.ResolveInterval == nil {
+		config.ResolveInterval = new(int)
+		*config.ResolveInterval = 300000
+	} else if *config.ResolveInterval < 1000 {
+		*config.ResolveInterval = 1000
+	}
+
 	config.DataBase, _ = readString(dat, "DataBase")
 	if config.DataBase == nil {
 		config.DataBase = new(string)
@@ -205,6 +440,26 @@ func ReadConfig(configFile string) (config Config, err error) {
 		}
 	}
 
+	config.Namespace, err = readString(dat, "Namespace")
+	if err != nil {
+		if err.Error() == "invalid format" {
+			return config, errors.New("'Namespace' has an invalid format")
+		}
+	}
+	if config.Namespace == nil {
+		config.Namespace = new(string)
+	}
+
+	config.Interface, err = readString(dat, "Interface")
+	if err != nil {
+		if err.Error() == "invalid format" {
+			return config, errors.New("'Interface' has an invalid format")
+		}
+	}
+	if config.Interface == nil {
+		config.Interface = new(string)
+	}
+
 	config.Peers, err = readPeers(dat, "Peers")
 	if err != nil {
 		return config, err
@@ -225,26 +480,211 @@ func ReadConfig(configFile string) (config Config, err error) {
 			*config.Peers[i].Timeout = 10
 		}
 
+		if config.Peers[i].ResolveInterval == nil {
+			config.Peers[i].ResolveInterval = config.ResolveInterval
+		} else if *config.Peers[i].ResolveInterval < 1000 {
+			*config.Peers[i].ResolveInterval = 1000
+		}
+
+		if config.Peers[i].Type == nil {
+			config.Peers[i].Type = new(string)
+			*config.Peers[i].Type = PeerTypeICMP
+		}
+		*config.Peers[i].Type = strings.ToLower(*config.Peers[i].Type)
+		switch *config.Peers[i].Type {
+		case PeerTypeICMP:
+		case PeerTypeMTU:
+			// the probes are sent through the listener with the DF bit
+			config.Peers[i].DontFragment = true
+			if config.Peers[i].MaxMTU == nil {
+				config.Peers[i].MaxMTU = new(int)
+				*config.Peers[i].MaxMTU = 1500
+			} else if *config.Peers[i].MaxMTU > 65535 {
+				*config.Peers[i].MaxMTU = 65535
+			}
+		case PeerTypeTCP:
+			if config.Peers[i].Port == nil || *config.Peers[i].Port <= 0 || *config.Peers[i].Port > 65535 {
+				return config, fmt.Errorf("'%s' needs a valid Port\n", *config.Peers[i].Address)
+			}
+		case PeerTypeHTTP:
+			u, err := url.Parse(*config.Peers[i].Address)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return config, fmt.Errorf("'%s' is not a valid http or https URL\n", *config.Peers[i].Address)
+			}
+			if config.Peers[i].Match != nil {
+				config.Peers[i].match, err = regexp.Compile(*config.Peers[i].Match)
+				if err != nil {
+					return config, fmt.Errorf("'%s' is not a valid regular expression: %v\n", *config.Peers[i].Match, err)
+				}
+			}
+		case PeerTypeDNS:
+			if config.Peers[i].QueryName == nil {
+				return config, fmt.Errorf("'%s' needs a QueryName\n", *config.Peers[i].Address)
+			}
+			if config.Peers[i].QueryType == nil {
+				config.Peers[i].QueryType = new(string)
+				*config.Peers[i].QueryType = "A"
+			}
+			*config.Peers[i].QueryType = strings.ToUpper(*config.Peers[i].QueryType)
+			config.Peers[i].question, err = parseQuestion(*config.Peers[i].QueryName, *config.Peers[i].QueryType)
+			if err != nil {
+				return config, fmt.Errorf("'%s' is not a valid query: %v\n", *config.Peers[i].QueryName, err)
+			}
+			if config.Peers[i].Protocol == nil {
+				config.Peers[i].Protocol = new(string)
+				*config.Peers[i].Protocol = DNSProtocolUDP
+			}
+			*config.Peers[i].Protocol = strings.ToLower(*config.Peers[i].Protocol)
+			if *config.Peers[i].Protocol != DNSProtocolUDP && *config.Peers[i].Protocol != DNSProtocolTCP {
+				return config, fmt.Errorf("'Protocol' must be %s or %s\n", DNSProtocolUDP, DNSProtocolTCP)
+			}
+			if config.Peers[i].Port != nil && (*config.Peers[i].Port <= 0 || *config.Peers[i].Port > 65535) {
+				return config, fmt.Errorf("'%s' needs a valid Port\n", *config.Peers[i].Address)
+			}
+		case PeerTypeUDP:
+			if config.Peers[i].Port != nil && (*config.Peers[i].Port <= 0 || *config.Peers[i].Port > 65535) {
+				return config, fmt.Errorf("'%s' needs a valid Port\n", *config.Peers[i].Address)
+			}
+		case PeerTypeARP:
+			// the requests are sent on the link of the interface
+			if *config.Interface == "" && (config.Peers[i].Interface == nil || *config.Peers[i].Interface == "") {
+				return config, fmt.Errorf("'%s' needs an Interface\n", *config.Peers[i].Address)
+			}
+		default:
+			return config, fmt.Errorf("'%s' is not a valid type, must be one of %s\n", *config.Peers[i].Type, strings.Join(peerTypes, ", "))
+		}
+
+		if config.Peers[i].MaxHops == nil {
+			config.Peers[i].MaxHops = new(int)
+		} else if *config.Peers[i].MaxHops > 255 {
+			*config.Peers[i].MaxHops = 255
+		}
+
+		if config.Peers[i].RouteInterval == nil {
+			config.Peers[i].RouteInterval = new(int)
+		} else if *config.Peers[i].RouteInterval > 0 && *config.Peers[i].RouteInterval < 10000 {
+			*config.Peers[i].RouteInterval = 10000
+		}
+
+		if config.Peers[i].Size == nil {
+			config.Peers[i].Size = new(int)
+			*config.Peers[i].Size = EchoPayloadLength
+		} else if *config.Peers[i].Size < EchoPayloadLength {
+			*config.Peers[i].Size = EchoPayloadLength
+		} else if *config.Peers[i].Size > MaxEchoPayloadLength {
+			*config.Peers[i].Size = MaxEchoPayloadLength
+		}
+
+		if config.Peers[i].Count == nil {
+			config.Peers[i].Count = new(int)
+			*config.Peers[i].Count = 1
+		} else if *config.Peers[i].Count < 1 {
+			*config.Peers[i].Count = 1
+		} else if *config.Peers[i].Count > 100 {
+			*config.Peers[i].Count = 100
+		}
+
+		if config.Peers[i].Spacing == nil {
+			config.Peers[i].Spacing = new(int)
+			*config.Peers[i].Spacing = 100
+		} else if *config.Peers[i].Spacing < 10 {
+			*config.Peers[i].Spacing = 10
+		}
+		// otherwise the bursts overlap and pile up
+		if burst := (*config.Peers[i].Count-1)**config.Peers[i].Spacing + *config.Peers[i].Timeout; *config.Peers[i].Count > 1 && burst > *config.Peers[i].Interval {
+			return config, fmt.Errorf("'%s' sends a burst that lasts %dms with its Count, Spacing and Timeout, it must fit in the Interval of %dms\n", *config.Peers[i].Address, burst, *config.Peers[i].Interval)
+		}
+
+		if config.Peers[i].Pattern != nil {
+			config.Peers[i].pattern, err = hex.DecodeString(strings.TrimPrefix(*config.Peers[i].Pattern, "0x"))
+			if err != nil || len(config.Peers[i].pattern) == 0 {
+				return config, fmt.Errorf("'%s' is not a valid pattern\n", *config.Peers[i].Pattern)
+			}
+		}
+
+		// hostnames get resolved later on, URLs by the http client
 		config.Peers[i].ip = net.ParseIP(*config.Peers[i].Address)
-		if config.Peers[i].ip == nil {
-			return config, fmt.Errorf("'%s' is not a valid IP address\n", *config.Peers[i].Address)
+		if config.Peers[i].ip == nil && *config.Peers[i].Type != PeerTypeHTTP && strings.ContainsAny(*config.Peers[i].Address, " /:") {
+			return config, fmt.Errorf("'%s' is neither a valid IP address nor a hostname\n", *config.Peers[i].Address)
+		}
+		if config.Peers[i].Timestamps && (*config.Peers[i].Type != PeerTypeICMP || (config.Peers[i].IP() != nil && config.Peers[i].IP().To4() == nil)) {
+			return config, fmt.Errorf("'%s' cannot get ICMP timestamps, they only exist for IPv4 peers of the type %s\n", *config.Peers[i].Address, PeerTypeICMP)
+		}
+		if config.Peers[i].DSCP != nil && *config.Peers[i].Type != PeerTypeICMP && *config.Peers[i].Type != PeerTypeUDP {
+			return config, fmt.Errorf("'%s' cannot have a DSCP, only peers of the types %s and %s can\n", *config.Peers[i].Address, PeerTypeICMP, PeerTypeUDP)
 		}
+		if config.Peers[i].MinMOS != nil && (!config.Peers[i].ratesCalls() || *config.Peers[i].MinMOS < 1 || *config.Peers[i].MinMOS > 4.5) {
+			return config, fmt.Errorf("'%s' cannot have a MinMOS, it must be between 1 and 4.5 for peers of the types %s and %s\n", *config.Peers[i].Address, PeerTypeICMP, PeerTypeUDP)
+		}
+		if config.Peers[i].Source != nil {
+			source := net.ParseIP(*config.Peers[i].Source)
+			if source == nil {
+				return config, fmt.Errorf("'%s' is not a valid IP address\n", *config.Peers[i].Source)
+			}
+			ip := config.Peers[i].IP()
+			if ip != nil && (ip.To4() == nil) != (source.To4() == nil) {
+				return config, fmt.Errorf("'%s' cannot be pinged from '%s'\n", *config.Peers[i].Address, *config.Peers[i].Source)
+			}
+		}
+
 		if config.Peers[i].Name == nil {
-			config.Peers[i].Name = config.Peers[i].Address
+			config.Peers[i].Name = new(string)
+			*config.Peers[i].Name = config.Peers[i].Target()
+			// the scheme of a URL already tells the type
+			if *config.Peers[i].Type != PeerTypeICMP && *config.Peers[i].Type != PeerTypeHTTP {
+				*config.Peers[i].Name = *config.Peers[i].Type + " " + *config.Peers[i].Name
+			}
+			if *config.Peers[i].Type == PeerTypeDNS {
+				*config.Peers[i].Name += " " + config.Peers[i].question.Name.String() + " " + *config.Peers[i].QueryType
+				if *config.Peers[i].Protocol == DNSProtocolTCP {
+					*config.Peers[i].Name += " over tcp"
+				}
+			}
+			if path := config.Peers[i].Path(); path != "" {
+				*config.Peers[i].Name += " via " + path
+			}
+			if config.Peers[i].Namespace != nil && *config.Peers[i].Namespace != "" {
+				*config.Peers[i].Name += " in " + *config.Peers[i].Namespace
+			}
+			if config.Peers[i].dscp() > 0 {
+				*config.Peers[i].Name += " DSCP " + strconv.Itoa(config.Peers[i].dscp())
+			}
+		} else if config.Peers[i].dscpSeries && config.Peers[i].dscp() > 0 {
+			*config.Peers[i].Name += " DSCP " + strconv.Itoa(config.Peers[i].dscp())
 		}
 		if config.Peers[i].ID == nil {
 			config.Peers[i].ID = new(int64)
-			*config.Peers[i].ID = int64(crc32.Checksum([]byte(*config.Peers[i].Address), crc32q))
+			key := config.Peers[i].Target()
+			// peers that got pinged through the default path keep their id
+			if path := config.Peers[i].Path(); path != "" {
+				key += " via " + path
+			}
+			if *config.Peers[i].Type != PeerTypeICMP {
+				key = *config.Peers[i].Type + " " + key
+			}
+			// every query to the same name server is a peer of its own
+			if *config.Peers[i].Type == PeerTypeDNS {
+				key += " " + config.Peers[i].question.Name.String() + " " + *config.Peers[i].QueryType + " " + *config.Peers[i].Protocol
+			}
+			// the same address in another namespace is another host
+			if config.Peers[i].Namespace != nil && *config.Peers[i].Namespace != "" {
+				key += " in " + *config.Peers[i].Namespace
+			}
+			// peers without a DSCP value keep their id
+			if config.Peers[i].dscp() > 0 {
+				key += " dscp " + strconv.Itoa(config.Peers[i].dscp())
+			}
+			*config.Peers[i].ID = int64(crc32.Checksum([]byte(key), crc32q))
 		}
 	}
 
 	// search for double IDS
-	for i, peer1 := range config.Peers {
-		for j, peer2 := range config.Peers {
-			if i != j && *peer1.ID == *peer2.ID {
-				return config, fmt.Errorf("The peers %s and %s got the same IDs", *peer1.Address, *peer2.Address)
-			}
+	config.peersByID = make(map[int64]*Peer, len(config.Peers))
+	for i := range config.Peers {
+		if peer, ok := config.peersByID[*config.Peers[i].ID]; ok {
+			return config, fmt.Errorf("The peers %s and %s got the same IDs", *peer.Address, *config.Peers[i].Address)
 		}
+		config.peersByID[*config.Peers[i].ID] = &config.Peers[i]
 	}
 
 	config.ListenAddress, err = readString(dat, "ListenAddress")
@@ -258,5 +698,148 @@ func ReadConfig(configFile string) (config Config, err error) {
 		*config.ListenAddress = ":8000"
 	}
 
-	return config, err
+	config.ICMPMode, err = readString(dat, "ICMPMode")
+	if err != nil {
+		if err.Error() == "invalid format" {
+			return config, errors.New("'ICMPMode' has an invalid format")
+		}
+	}
+	if config.ICMPMode == nil {
+		config.ICMPMode = new(string)
+		*config.ICMPMode = ICMPModeAuto
+	}
+	*config.ICMPMode = strings.ToLower(*config.ICMPMode)
+	switch *config.ICMPMode {
+	case ICMPModeAuto, ICMPModePrivileged, ICMPModeUnprivileged:
+	default:
+		return config, fmt.Errorf("'ICMPMode' must be one of %s, %s or %s", ICMPModeAuto, ICMPModePrivileged, ICMPModeUnprivileged)
+	}
+
+	config.SourceIPv4, err = readSource(dat, "SourceIPv4", 4)
+	if err != nil {
+		return config, err
+	}
+	if config.SourceIPv4 == nil {
+		config.SourceIPv4 = new(string)
+		*config.SourceIPv4 = "0.0.0.0"
+	}
+
+	config.SourceIPv6, err = readSource(dat, "SourceIPv6", 6)
+	if err != nil {
+		return config, err
+	}
+	if config.SourceIPv6 == nil {
+		config.SourceIPv6 = new(string)
+		*config.SourceIPv6 = "::"
+	}
+
+	if timestamps, _ := readInt(dat, "KernelTimestamps"); timestamps != nil {
+		config.KernelTimestamps = *timestamps != 0
+	}
+
+	return config, nil
+}
+
+// readSource reads a source address for the ip version, it returns nil if name was not found
+func readSource(amap map[string]interface{}, name string, ipVersion int) (*string, error) {
+	str, err := readString(amap, name)
+	if err != nil {
+		if err.Error() == "invalid format" {
+			return nil, fmt.Errorf("'%s' has an invalid format", name)
+		}
+		return nil, nil
+	}
+	ip := net.ParseIP(*str)
+	if ip == nil || (ip.To4() != nil) != (ipVersion == 4) {
+		return nil, fmt.Errorf("'%s' is not a valid IPv%d address", *str, ipVersion)
+	}
+	return str, nil
+}
+
+// peerLock guards the resolved ip and the sequence numbers of all peers
+var peerLock sync.RWMutex
+
+// IsHostname returns true if the Address of the peer needs to be resolved,
+// the http client resolves the URLs of PeerTypeHTTP itself
+func (peer *Peer) IsHostname() bool {
+	return *peer.Type != PeerTypeHTTP && net.ParseIP(*peer.Address) == nil
+}
+
+// StatusOK returns true if an http response with code counts as up
+func (peer *Peer) StatusOK(code int) bool {
+	if peer.Status != nil && *peer.Status > 0 {
+		return code == *peer.Status
+	}
+	return code >= 200 && code < 400
+}
+
+// IP returns the current ip of the peer, it is nil if the hostname was not resolved yet
+func (peer *Peer) IP() net.IP {
+	peerLock.RLock()
+	defer peerLock.RUnlock()
+	return peer.ip
+}
+
+// Target returns the Address of the peer, with the Port if it has one
+func (peer *Peer) Target() string {
+	if peer.Port != nil {
+		return net.JoinHostPort(*peer.Address, strconv.Itoa(*peer.Port))
+	}
+	return *peer.Address
+}
+
+// UsesICMP returns true if the peer needs ICMP listeners
+func (peer *Peer) UsesICMP() bool {
+	return *peer.Type == PeerTypeICMP || *peer.Type == PeerTypeMTU || *peer.MaxHops > 0 || *peer.RouteInterval > 0
+}
+
+// Path returns the source and interface the peer is pinged through,
+// it is empty if the peer uses the default path
+func (peer *Peer) Path() string {
+	var path []string
+	if peer.Source != nil && *peer.Source != "" {
+		path = append(path, *peer.Source)
+	}
+	if peer.Interface != nil && *peer.Interface != "" {
+		path = append(path, *peer.Interface)
+	}
+	return strings.Join(path, " on ")
+}
+
+// namespace returns the network namespace the peer is probed from, it is empty for the one of icmpmon
+func (peer *Peer) namespace() string {
+	if peer.Namespace != nil {
+		return *peer.Namespace
+	}
+	return *config.Namespace
+}
+
+// dscp returns the DSCP value of the peer, 0 if it has none
+func (peer *Peer) dscp() int {
+	if peer.DSCP == nil {
+		return 0
+	}
+	return *peer.DSCP
+}
+
+// peerByID returns the peer with the id, nil if there is none
+func peerByID(id int64) *Peer {
+	return config.peersByID[id]
+}
+
+// nextSeq returns the sequence number for the next echo request to the peer
+func (peer *Peer) nextSeq() int {
+	peerLock.Lock()
+	defer peerLock.Unlock()
+	if peer.seq >= 65535 {
+		peer.seq = 0
+	}
+	peer.seq++
+	return peer.seq
+}
+
+func (peer *Peer) setIP(ip net.IP) {
+	peerLock.Lock()
+	peer.ip = ip
+	peerLock.Unlock()
 }
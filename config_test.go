@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// readTestConfig reads the config from text, the hjson of a config file
+func readTestConfig(t *testing.T, text string) (Config, error) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "icmpmon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "config.hjson")
+	if err = ioutil.WriteFile(file, []byte(text), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return ReadConfig(file)
+}
+
+// useTestConfig makes the config of text the global config and returns its peers
+func useTestConfig(t *testing.T, text string) []Peer {
+	t.Helper()
+	c, err := readTestConfig(t, text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config = c
+	return config.Peers
+}
+
+func TestBurstFitsInterval(t *testing.T) {
+	tests := []struct {
+		peer string
+		ok   bool
+	}{
+		{"Count: 1\nInterval: 500\nTimeout: 1000", true},
+		{"Count: 5\nSpacing: 100\nTimeout: 500\nInterval: 1000", true},
+		{"Count: 5\nSpacing: 100\nTimeout: 1000\nInterval: 1000", false},
+		// the minimum Spacing
+		{"Count: 100\nSpacing: 1\nTimeout: 100\nInterval: 1090", true},
+		{"Count: 100\nSpacing: 1\nTimeout: 100\nInterval: 1000", false},
+	}
+	for _, test := range tests {
+		_, err := readTestConfig(t, "{\nPeers: [\n{\nAddress: 127.0.0.1\n"+test.peer+"\n}\n]\n}")
+		if (err == nil) != test.ok {
+			t.Errorf("%q: got the error %v", test.peer, err)
+		}
+	}
+}
+
+func TestDSCPSeries(t *testing.T) {
+	tests := []struct {
+		peer   string
+		series int
+	}{
+		{`DSCP: [0, "AF41", "EF"]`, 3},
+		{"DSCP: [\n0\nAF41\nEF\n]", 3},
+		{"DSCP: EF\nID: 5", 1},
+		{`DSCP: [0, 46]` + "\nID: 5", 0},
+		{"DSCP: 64", 0},
+	}
+	for _, test := range tests {
+		c, err := readTestConfig(t, "{\nPeers: [\n{\nAddress: 127.0.0.1\n"+test.peer+"\n}\n]\n}")
+		if test.series == 0 {
+			if err == nil {
+				t.Errorf("%q: got no error", test.peer)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: got the error %v", test.peer, err)
+			continue
+		}
+		if len(c.Peers) != test.series {
+			t.Errorf("%q: got %d series, want %d", test.peer, len(c.Peers), test.series)
+		}
+	}
+}
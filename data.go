@@ -1,33 +1,231 @@
 package main
 
 import (
+	"fmt"
 	"net"
+	"time"
 
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/sqlite"
 )
 
+const (
+	OutcomeOK               = "ok"
+	OutcomeTimeout          = "timeout"
+	OutcomeUnreachable      = "unreachable"
+	OutcomeTimeExceeded     = "time exceeded"
+	OutcomePacketTooBig     = "packet too big"
+	OutcomeParameterProblem = "parameter problem"
+	// OutcomeCorrupted is an echo reply that did not carry the data of its request
+	OutcomeCorrupted = "corrupted"
+	// OutcomeRefused is a connection the peer refused
+	OutcomeRefused = "refused"
+	// OutcomeDNSFailed is a hostname of a URL that could not be resolved
+	OutcomeDNSFailed = "dns failed"
+	// OutcomeTLSFailed is a TLS handshake that failed, e.g. because of an invalid certificate
+	OutcomeTLSFailed = "tls failed"
+	// OutcomeBadStatus is an http response with a status code that does not count as up
+	OutcomeBadStatus = "bad status"
+	// OutcomeNoMatch is an http response with a body that did not match
+	OutcomeNoMatch = "no match"
+	// OutcomeBadRcode is a dns response with SERVFAIL or NXDOMAIN
+	OutcomeBadRcode = "bad rcode"
+	// OutcomeLate is the reply to a test packet of a udp peer that arrived after the reply
+	// to a later one, the test packet was counted as lost when that one arrived
+	OutcomeLate = "late"
+	// OutcomeNoData marks a gap without queries in the data of a peer, it is never stored
+	OutcomeNoData = "no data"
+)
+
 type Query struct {
 	PeerID int64 `gorm:"not null" json:"-"`
-	// ResponseTime is in Milliseconds
-	ResponseTime int64 `gorm:"not null"`
+	// ResponseTime is in Milliseconds, -1 if there was no response
+	ResponseTime float64 `gorm:"not null"`
 	// Time is a UNIX Timestamp in Milliseconds
 	Time int64 `gorm:"not null"`
+	// Outcome is one of the Outcome constants
+	Outcome string
+	// Code is the ICMP code of an error
+	Code int `json:",omitempty"`
+	// Reporter is the address of the router that sent an error
+	Reporter string `json:",omitempty"`
+	// MTU is the MTU of the next hop that was reported with a packet too big error
+	MTU int `json:",omitempty"`
+	// TTL is the TTL (hop limit for IPv6) of the echo reply, 0 if it is unknown
+	TTL int `json:",omitempty"`
+	// DNSTime, ConnectTime and TLSTime are the Milliseconds the phases of an http request took,
+	// FirstByteTime is the time from sending the request to the first byte of the response
+	DNSTime       float64 `json:",omitempty"`
+	ConnectTime   float64 `json:",omitempty"`
+	TLSTime       float64 `json:",omitempty"`
+	FirstByteTime float64 `json:",omitempty"`
+	// StatusCode is the status code of an http response
+	StatusCode int `json:",omitempty"`
+	// Rcode is the response code of a dns response
+	Rcode int `json:",omitempty"`
+	// Answers is the number of records in the answer section of a dns response
+	Answers int `json:",omitempty"`
+	// ForwardLoss and BackwardLoss are the numbers of test packets of PeerTypeUDP that got lost
+	// on the way to and from the reflector since the last reply that arrived in order
+	ForwardLoss  int `json:",omitempty"`
+	BackwardLoss int `json:",omitempty"`
+	// Reordered is true if the reply arrived after the reply to a later test packet or echo request
+	Reordered bool `json:",omitempty"`
+	// ForwardDelayVariation and BackwardDelayVariation are the Milliseconds the one way delays
+	// changed by since the last reply that arrived in order
+	ForwardDelayVariation  float64 `json:",omitempty"`
+	BackwardDelayVariation float64 `json:",omitempty"`
+	// Sent is the number of echo requests of a burst, the ResponseTime is the average of their replies
+	Sent int `json:",omitempty"`
+	// Loss is the percentage of the echo requests of a burst that got no reply
+	Loss float64 `json:",omitempty"`
+	// MinResponseTime, MaxResponseTime and StdDev are in Milliseconds,
+	// they are the minimum, the maximum and the standard deviation of the replies of a burst
+	MinResponseTime float64 `json:",omitempty"`
+	MaxResponseTime float64 `json:",omitempty"`
+	StdDev          float64 `json:",omitempty"`
+	// Jitter is the mean difference of the response times of successive replies in Milliseconds
+	Jitter float64 `json:",omitempty"`
+	// InterarrivalJitter is the jitter estimate of RFC 3550 over the response times of the peer
+	// until this query in Milliseconds
+	InterarrivalJitter float64 `json:",omitempty"`
+	// Duplicates is the number of duplicate echo replies of the peer since the last query
+	Duplicates int `json:",omitempty"`
+	// RFactor is the rating (0 to 100) of the E-model for a call over the path of the peer
+	// and MOS the mean opinion score (1 to 4.5) of it, see rFactor
+	RFactor float64 `json:",omitempty"`
+	MOS     float64 `json:",omitempty"`
+	// HardwareAddr is the MAC address a peer of the type PeerTypeARP answered with
+	HardwareAddr string `json:",omitempty"`
 }
 
-type Request struct {
-	ID int
-	IP net.IP
+// EventAddressChanged gets recorded when the hostname of a peer resolves to a different ip
+const EventAddressChanged = "address"
+
+// EventMTUShrunk gets recorded when the path MTU of a peer got smaller
+const EventMTUShrunk = "mtu"
+
+// EventHopCountChanged gets recorded when the number of hops the echo replies of a peer
+// took changed, it is inferred from their TTL
+const EventHopCountChanged = "hops"
+
+// EventRouteChanged gets recorded when the route to a peer differs from the last snapshot,
+// Old and New are the space separated hops
+const EventRouteChanged = "route"
+
+// EventMOSChanged gets recorded when the MOS of a peer fell below its MinMOS or recovered
+const EventMOSChanged = "mos"
+
+// Event is something that happened to a peer, e.g. the change of its ip.
+type Event struct {
+	PeerID int64 `gorm:"not null" json:"-"`
 	// Time is a UNIX Timestamp in Milliseconds
-	Time int64
-	Peer *Peer
+	Time int64  `gorm:"not null"`
+	Type string `gorm:"not null"`
+	Old  string
+	New  string
+}
+
+// RequestKey identifies a pending request, every peer has its own sequence numbers
+type RequestKey struct {
+	PeerID int64
+	EchoID int
+	Seq    int
+}
+
+type Request struct {
+	EchoID int
+	Seq    int
+	IP     net.IP
+	// Sent is the time the request was sent at, it contains a monotonic clock reading
+	Sent     time.Time
+	Peer     *Peer
+	Listener *Listener
+	// Payload is the data that was sent with the echo request
+	Payload []byte
+	// Result gets the query of the request instead of the database if it is set
+	Result chan<- Query
+	// Timestamp is true for ICMP timestamp requests, they get a ClockSample instead of a Query
+	Timestamp bool
+}
+
+// Key returns the key the request is pending with
+func (request *Request) Key() RequestKey {
+	return RequestKey{PeerID: *request.Peer.ID, EchoID: request.EchoID, Seq: request.Seq}
 }
 
 type Response struct {
-	ID int
-	IP net.IP
+	EchoID int
+	Seq    int
+	IP     net.IP
+	// Received is the time the response was received at, it contains a monotonic clock reading
+	Received time.Time
+	// Listener is the listener the response was received on
+	Listener *Listener
+	// Payload is the data of the echo reply or of the request an error was reported for
+	Payload []byte
+	// Outcome is OutcomeOK for echo replies, otherwise the IP is the destination of the
+	// request the error was reported for and Reporter the router that reported it
+	Outcome  string
+	Code     int
+	Reporter net.IP
+	// MTU is set for OutcomePacketTooBig if it is known
+	MTU int
+	// TTL is the TTL (hop limit for IPv6) of the echo reply, 0 if it is unknown
+	TTL int
+	// Timestamps is only set for ICMP timestamp replies
+	Timestamps *ICMPTimestamps
+}
+
+// InvalidReply is an echo reply that matches a request by its sequence number,
+// but not by its source or payload
+type InvalidReply struct {
+	PeerID int64 `gorm:"not null" json:"-"`
 	// Time is a UNIX Timestamp in Milliseconds
-	Time int64
+	Time   int64 `gorm:"not null"`
+	IP     string
+	Reason string
+}
+
+// PathMTU is the largest packet that got through to a peer with the DF bit set
+type PathMTU struct {
+	PeerID int64 `gorm:"not null" json:"-"`
+	// Time is a UNIX Timestamp in Milliseconds
+	Time int64 `gorm:"not null"`
+	MTU  int   `gorm:"not null"`
+}
+
+// Hop is the result of an echo request to a peer that had its TTL limited to the position of the hop
+type Hop struct {
+	PeerID int64 `gorm:"not null" json:"-"`
+	// Time is a UNIX Timestamp in Milliseconds
+	Time int64 `gorm:"not null"`
+	// TTL is the position of the hop on the path, it starts at 1
+	TTL int `gorm:"not null"`
+	// IP is the address of the router (or the peer) that replied, it is empty if there was no reply
+	IP string
+	// ResponseTime is in Milliseconds, -1 if there was no reply
+	ResponseTime float64 `gorm:"not null"`
+	// Outcome is OutcomeTimeExceeded for a router and OutcomeOK for the peer
+	Outcome string
+}
+
+// ClockSample is the result of an ICMP timestamp request to a peer
+type ClockSample struct {
+	PeerID int64 `gorm:"not null" json:"-"`
+	// Time is a UNIX Timestamp in Milliseconds
+	Time int64 `gorm:"not null"`
+	// Forward and Return are the Milliseconds from the local clock to the clock of the peer and back,
+	// they are only the one way delays if both clocks are in sync
+	Forward float64 `gorm:"not null"`
+	Return  float64 `gorm:"not null"`
+	// Offset is the Milliseconds the clock of the peer is ahead of the local one
+	Offset float64 `gorm:"not null"`
+	// Originate, Receive and Transmit are the times of the timestamp reply
+	// in Milliseconds since midnight UTC, like the peer sent them
+	Originate uint32
+	Receive   uint32
+	Transmit  uint32
 }
 
 type DB struct {
@@ -41,6 +239,69 @@ func NewDB(file string) (*DB, error) {
 	if err != nil {
 		return nil, err
 	}
-	db.AutoMigrate(&Query{})
+	err = db.migrate()
+	if err != nil {
+		return nil, err
+	}
+	db.AutoMigrate(&Query{}, &Event{}, &InvalidReply{}, &PathMTU{}, &Hop{}, &ClockSample{})
 	return &db, nil
 }
+
+// migrations upgrade the database of older versions,
+// migrations[i] upgrades from version i to i+1 (stored in PRAGMA user_version)
+var migrations = []func(tx *gorm.DB) error{
+	// ResponseTime was stored in whole Milliseconds
+	func(tx *gorm.DB) error {
+		err := tx.Exec("ALTER TABLE queries RENAME TO queries_int").Error
+		if err != nil {
+			return err
+		}
+		err = tx.Exec(`CREATE TABLE "queries" ("peer_id" bigint NOT NULL,"response_time" real NOT NULL,"time" bigint NOT NULL)`).Error
+		if err != nil {
+			return err
+		}
+		// the values are kept as they were measured, responses faster than a millisecond stay 0
+		err = tx.Exec("INSERT INTO queries (peer_id, response_time, time) SELECT peer_id, response_time, time FROM queries_int").Error
+		if err != nil {
+			return err
+		}
+		return tx.Exec("DROP TABLE queries_int").Error
+	},
+	// Outcome was added, before it was only known by ResponseTime
+	func(tx *gorm.DB) error {
+		err := tx.Exec("ALTER TABLE queries ADD COLUMN outcome varchar(255)").Error
+		if err != nil {
+			return err
+		}
+		return tx.Exec("UPDATE queries SET outcome = CASE WHEN response_time < 0 THEN ? ELSE ? END", OutcomeTimeout, OutcomeOK).Error
+	},
+}
+
+func (db *DB) migrate() error {
+	var version int
+	if !db.HasTable(&Query{}) {
+		// a new database is always up to date
+		version = len(migrations)
+	} else {
+		err := db.Raw("PRAGMA user_version").Row().Scan(&version)
+		if err != nil {
+			return err
+		}
+	}
+	for ; version < len(migrations); version++ {
+		tx := db.Begin()
+		err := migrations[version](tx)
+		if err == nil {
+			err = tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", version+1)).Error
+		}
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("unable to migrate database to version %d: %v", version+1, err)
+		}
+		err = tx.Commit().Error
+		if err != nil {
+			return err
+		}
+	}
+	return db.Exec(fmt.Sprintf("PRAGMA user_version = %d", version)).Error
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+)
+
+func TestMigrateWholeMilliseconds(t *testing.T) {
+	dir, err := ioutil.TempDir("", "icmpmon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "data.db")
+
+	// the database of the first version stored whole Milliseconds
+	old, err := gorm.Open("sqlite3", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, statement := range []string{
+		`CREATE TABLE "queries" ("peer_id" bigint NOT NULL,"response_time" bigint NOT NULL,"time" bigint NOT NULL)`,
+		"INSERT INTO queries VALUES (1, 0, 1000), (1, 12, 2000), (1, -1, 3000)",
+	} {
+		if err = old.Exec(statement).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	old.Close()
+
+	db, err := NewDB(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var queries []Query
+	if err = db.Order("time").Find(&queries).Error; err != nil {
+		t.Fatal(err)
+	}
+	want := []Query{
+		{ResponseTime: 0, Outcome: OutcomeOK},
+		{ResponseTime: 12, Outcome: OutcomeOK},
+		{ResponseTime: -1, Outcome: OutcomeTimeout},
+	}
+	if len(queries) != len(want) {
+		t.Fatalf("got %d queries after the migration, want %d", len(queries), len(want))
+	}
+	for i := range want {
+		if queries[i].ResponseTime != want[i].ResponseTime || queries[i].Outcome != want[i].Outcome {
+			t.Errorf("query %d is %f %s after the migration, want %f %s", i, queries[i].ResponseTime, queries[i].Outcome, want[i].ResponseTime, want[i].Outcome)
+		}
+	}
+}
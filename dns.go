@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// DNSPort is the port PeerTypeDNS sends its queries to if Port of the peer is not set
+const DNSPort = 53
+
+const (
+	// DNSProtocolUDP sends the queries of PeerTypeDNS in datagrams
+	DNSProtocolUDP = "udp"
+	// DNSProtocolTCP sends the queries of PeerTypeDNS through a new connection every time
+	DNSProtocolTCP = "tcp"
+)
+
+// dnsTypes are the record types PeerTypeDNS can query
+var dnsTypes = map[string]dnsmessage.Type{
+	"A":     dnsmessage.TypeA,
+	"AAAA":  dnsmessage.TypeAAAA,
+	"CNAME": dnsmessage.TypeCNAME,
+	"MX":    dnsmessage.TypeMX,
+	"NS":    dnsmessage.TypeNS,
+	"PTR":   dnsmessage.TypePTR,
+	"SOA":   dnsmessage.TypeSOA,
+	"SRV":   dnsmessage.TypeSRV,
+	"TXT":   dnsmessage.TypeTXT,
+}
+
+// parseQuestion returns the question for the records of type recordType of name,
+// name does not need to end with a dot
+func parseQuestion(name string, recordType string) (dnsmessage.Question, error) {
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	n, err := dnsmessage.NewName(name)
+	if err != nil {
+		return dnsmessage.Question{}, err
+	}
+	t, ok := dnsTypes[strings.ToUpper(recordType)]
+	if !ok {
+		return dnsmessage.Question{}, fmt.Errorf("'%s' is not a supported record type", recordType)
+	}
+	return dnsmessage.Question{Name: n, Type: t, Class: dnsmessage.ClassINET}, nil
+}
+
+// probeDNS sends the query of the peer in the background,
+// the time until the response arrived gets sent to the collector
+func probeDNS(peer *Peer) error {
+	ip := peer.IP()
+	if ip == nil {
+		// hostname was not resolved yet
+		return nil
+	}
+	ipVersion := 6
+	if ip.To4() != nil {
+		ipVersion = 4
+	}
+	source, iface := peerSource(peer, ipVersion)
+	port := DNSPort
+	if peer.Port != nil {
+		port = *peer.Port
+	}
+	address := net.JoinHostPort(ip.String(), strconv.Itoa(port))
+
+	id := uint16(peer.nextSeq())
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, RecursionDesired: true})
+	if err := builder.StartQuestions(); err != nil {
+		return err
+	}
+	if err := builder.Question(peer.question); err != nil {
+		return err
+	}
+	message, err := builder.Finish()
+	if err != nil {
+		return err
+	}
+
+	dialer := net.Dialer{Control: dialControl(iface)}
+	if *peer.Protocol == DNSProtocolTCP {
+		dialer.LocalAddr = &net.TCPAddr{IP: net.ParseIP(source)}
+	} else {
+		dialer.LocalAddr = &net.UDPAddr{IP: net.ParseIP(source)}
+	}
+
+	go func() {
+		sent := time.Now()
+		dialer.Deadline = sent.Add(time.Duration(*peer.Timeout) * time.Millisecond)
+		header, answers, err := exchangeDNS(&dialer, peer.namespace(), *peer.Protocol, address, message, id)
+		received := time.Now()
+		query := Query{
+			PeerID:       *peer.ID,
+			Time:         received.UTC().UnixNano() / 1000000,
+			ResponseTime: -1,
+			Outcome:      OutcomeOK,
+			Rcode:        int(header.RCode),
+			Answers:      answers,
+		}
+		switch {
+		case err != nil:
+			query.Outcome = dialOutcome(err)
+			log.Printf("Got %s for %s (%v)\n", query.Outcome, *peer.Name, err)
+		case peer.FailOnRcode && (header.RCode == dnsmessage.RCodeServerFailure || header.RCode == dnsmessage.RCodeNameError):
+			query.Outcome = OutcomeBadRcode
+			log.Printf("Got %s for %s (%s)\n", query.Outcome, *peer.Name, header.RCode)
+		default:
+			query.ResponseTime = float64(received.Sub(sent)) / float64(time.Millisecond)
+		}
+		messages.In() <- query
+	}()
+	return nil
+}
+
+// exchangeDNS sends the query message with the id to address from the network namespace and waits for
+// its response until the deadline of the dialer, it returns the header and the number of answers of the response
+func exchangeDNS(dialer *net.Dialer, namespace string, network string, address string, message []byte, id uint16) (dnsmessage.Header, int, error) {
+	var conn net.Conn
+	err := inNamespace(namespace, func() (err error) {
+		conn, err = dialer.Dial(network, address)
+		return err
+	})
+	if err != nil {
+		return dnsmessage.Header{}, 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(dialer.Deadline)
+
+	// messages sent through a stream are prefixed with their length
+	if network == DNSProtocolTCP {
+		message = append([]byte{byte(len(message) >> 8), byte(len(message))}, message...)
+	}
+	if _, err = conn.Write(message); err != nil {
+		return dnsmessage.Header{}, 0, err
+	}
+
+	b := make([]byte, 65535)
+	for {
+		var n int
+		if network == DNSProtocolTCP {
+			if _, err = io.ReadFull(conn, b[:2]); err != nil {
+				return dnsmessage.Header{}, 0, err
+			}
+			n = int(b[0])<<8 | int(b[1])
+			if _, err = io.ReadFull(conn, b[:n]); err != nil {
+				return dnsmessage.Header{}, 0, err
+			}
+		} else if n, err = conn.Read(b); err != nil {
+			return dnsmessage.Header{}, 0, err
+		}
+
+		var parser dnsmessage.Parser
+		header, err := parser.Start(b[:n])
+		// e.g. the late response to an earlier query
+		if err != nil || !header.Response || header.ID != id {
+			continue
+		}
+		if err = parser.SkipAllQuestions(); err != nil {
+			return header, 0, nil
+		}
+		answers := 0
+		for {
+			if _, err = parser.AnswerHeader(); err != nil {
+				break
+			}
+			if err = parser.SkipAnswer(); err != nil {
+				break
+			}
+			answers++
+		}
+		return header, answers, nil
+	}
+}
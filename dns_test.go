@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// testDNSResponses answers the queries of the test name server,
+// late.example. first gets a response with another id
+func testDNSResponses(t *testing.T, query []byte) [][]byte {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(query)
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+	question, err := parser.Question()
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+	response := func(id uint16, rcode dnsmessage.RCode, answers int) []byte {
+		builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, Response: true, RCode: rcode})
+		builder.StartQuestions()
+		builder.Question(question)
+		builder.StartAnswers()
+		for i := 0; i < answers; i++ {
+			builder.AResource(dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: 60}, dnsmessage.AResource{A: [4]byte{192, 0, 2, byte(i + 1)}})
+		}
+		b, err := builder.Finish()
+		if err != nil {
+			t.Error(err)
+		}
+		return b
+	}
+	switch question.Name.String() {
+	case "fail.example.":
+		return [][]byte{response(header.ID, dnsmessage.RCodeServerFailure, 0)}
+	case "missing.example.":
+		return [][]byte{response(header.ID, dnsmessage.RCodeNameError, 0)}
+	case "late.example.":
+		return [][]byte{response(header.ID+1, dnsmessage.RCodeServerFailure, 0), response(header.ID, dnsmessage.RCodeSuccess, 1)}
+	}
+	return [][]byte{response(header.ID, dnsmessage.RCodeSuccess, 2)}
+}
+
+// startTestNameServer starts a name server on udp and tcp, it returns their ports
+func startTestNameServer(t *testing.T) (udpPort int, tcpPort int, stop func()) {
+	packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		b := make([]byte, 65535)
+		for {
+			n, addr, err := packetConn.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			for _, response := range testDNSResponses(t, b[:n]) {
+				packetConn.WriteTo(response, addr)
+			}
+		}
+	}()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				b := make([]byte, 65535)
+				if _, err := io.ReadFull(conn, b[:2]); err != nil {
+					return
+				}
+				n := int(binary.BigEndian.Uint16(b))
+				if _, err := io.ReadFull(conn, b[:n]); err != nil {
+					return
+				}
+				for _, response := range testDNSResponses(t, b[:n]) {
+					conn.Write(append([]byte{byte(len(response) >> 8), byte(len(response))}, response...))
+				}
+			}()
+		}
+	}()
+	return packetConn.LocalAddr().(*net.UDPAddr).Port, listener.Addr().(*net.TCPAddr).Port, func() {
+		packetConn.Close()
+		listener.Close()
+	}
+}
+
+func TestProbeDNS(t *testing.T) {
+	udpPort, tcpPort, stop := startTestNameServer(t)
+	defer stop()
+
+	tests := []struct {
+		name        string
+		failOnRcode bool
+		outcome     string
+		rcode       dnsmessage.RCode
+		answers     int
+	}{
+		{"ok.example", false, OutcomeOK, dnsmessage.RCodeSuccess, 2},
+		{"late.example", false, OutcomeOK, dnsmessage.RCodeSuccess, 1},
+		{"fail.example", false, OutcomeOK, dnsmessage.RCodeServerFailure, 0},
+		{"fail.example", true, OutcomeBadRcode, dnsmessage.RCodeServerFailure, 0},
+		{"missing.example", true, OutcomeBadRcode, dnsmessage.RCodeNameError, 0},
+	}
+	for _, protocol := range []string{DNSProtocolUDP, DNSProtocolTCP} {
+		port := udpPort
+		if protocol == DNSProtocolTCP {
+			port = tcpPort
+		}
+		for _, test := range tests {
+			failOnRcode := "0"
+			if test.failOnRcode {
+				failOnRcode = "1"
+			}
+			t.Run(protocol+" "+test.name+" "+failOnRcode, func(t *testing.T) {
+				peers := useTestConfig(t, "{\nPeers: [\n{\nType: dns\nAddress: 127.0.0.1\nPort: "+strconv.Itoa(port)+
+					"\nProtocol: "+protocol+"\nQueryName: "+test.name+"\nFailOnRcode: "+failOnRcode+"\n}\n]\n}")
+				query := probeTestPeer(t, &peers[0], probeDNS)
+				if query.Outcome != test.outcome || query.Rcode != int(test.rcode) || query.Answers != test.answers {
+					t.Fatalf("got %s with rcode %d and %d answers, want %s with rcode %d and %d answers",
+						query.Outcome, query.Rcode, query.Answers, test.outcome, test.rcode, test.answers)
+				}
+			})
+		}
+	}
+}
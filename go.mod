@@ -8,5 +8,6 @@ require (
 	github.com/jinzhu/gorm v1.9.15
 	github.com/kevinburke/go-bindata v3.21.0+incompatible
 	golang.org/x/net v0.0.0-20200707034311-ab3426394381
+	golang.org/x/sys v0.0.0-20200323222414-85ca7c5b95cd
 	gopkg.in/eapache/channels.v1 v1.1.0
 )
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// DefaultMaxHops is the number of hops a route snapshot covers if MaxHops of the peer is not set
+const DefaultMaxHops = 30
+
+// traceHops sends an echo request with every TTL up to maxHops to the peer, like mtr does
+// paced by the budget. It returns a Hop for every TTL up to the first one that reached the peer.
+func traceHops(peer *Peer, maxHops int, budget *packetBudget, quit <-chan struct{}) ([]Hop, error) {
+	ip := peer.IP()
+	if ip == nil {
+		// hostname was not resolved yet
+		return nil, nil
+	}
+	listener := peerListener(peer, ip)
+	if listener == nil {
+		return nil, fmt.Errorf("Unable to ping %s via %s", ip, peer.Path())
+	}
+
+	now := time.Now()
+	results := make([]chan Query, maxHops)
+	for i := range results {
+		if !budget.wait(1, quit) {
+			return nil, errQuit
+		}
+		results[i] = make(chan Query, 1)
+		if err := sendEcho(peer, ip, listener, *peer.Size, i+1, results[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	// the collector times out every request, this only guards against lost results
+	deadline := now.Add(time.Duration(*peer.Timeout)*time.Millisecond + 2*time.Second)
+	var hops []Hop
+	for i, result := range results {
+		hop := Hop{
+			PeerID:       *peer.ID,
+			Time:         now.UTC().UnixNano() / 1000000,
+			TTL:          i + 1,
+			ResponseTime: -1,
+			Outcome:      OutcomeTimeout,
+		}
+		select {
+		case query := <-result:
+			hop.Outcome = query.Outcome
+			hop.IP = query.Reporter
+			if query.Outcome != OutcomeTimeout {
+				hop.ResponseTime = query.ResponseTime
+			}
+		case <-time.After(time.Until(deadline)):
+		case <-quit:
+			return nil, errQuit
+		}
+		switch hop.Outcome {
+		case OutcomeTimeExceeded, OutcomeTimeout:
+			hops = append(hops, hop)
+			continue
+		case OutcomeOK, OutcomeCorrupted:
+			hop.IP = ip.String()
+		}
+		// the peer or the router that reported it as unreachable is the end of the path
+		hops = append(hops, hop)
+		break
+	}
+	return hops, nil
+}
+
+// hopJob returns the job that gets the time and loss to every hop on the path to the peer every Interval
+func hopJob(peer *Peer) *job {
+	return &job{
+		interval: time.Duration(*peer.Interval) * time.Millisecond,
+		packets:  *peer.MaxHops,
+		async:    true,
+		run: func(budget *packetBudget, quit <-chan struct{}) {
+			hops, err := traceHops(peer, *peer.MaxHops, budget, quit)
+			if err == errQuit {
+				return
+			}
+			if err != nil {
+				log.Printf("Unable to trace the hops to %s: %v\n", *peer.Name, err)
+			}
+			for _, hop := range hops {
+				messages.In() <- hop
+			}
+		},
+	}
+}
+
+// Route is the list of hops on the path to a peer, a hop that did not reply is "*"
+type Route []string
+
+// newRoute returns the route of hops, ok is false if the hops did not reach the peer
+func newRoute(hops []Hop) (route Route, ok bool) {
+	for _, hop := range hops {
+		if hop.IP == "" {
+			route = append(route, "*")
+		} else {
+			route = append(route, hop.IP)
+		}
+	}
+	return route, len(hops) > 0 && (hops[len(hops)-1].Outcome == OutcomeOK || hops[len(hops)-1].Outcome == OutcomeCorrupted)
+}
+
+// Equal reports whether both routes have the same hops,
+// a hop that did not reply matches every hop
+func (route Route) Equal(other Route) bool {
+	if len(route) != len(other) {
+		return false
+	}
+	for i := range route {
+		if route[i] != other[i] && route[i] != "*" && other[i] != "*" {
+			return false
+		}
+	}
+	return true
+}
+
+// fill returns the route with the hops that did not reply taken from the last route,
+// so a hop that stays silent for a snapshot cannot hide that it changed
+func (route Route) fill(last Route) Route {
+	if len(route) != len(last) {
+		return route
+	}
+	filled := make(Route, len(route))
+	for i := range route {
+		filled[i] = route[i]
+		if route[i] == "*" {
+			filled[i] = last[i]
+		}
+	}
+	return filled
+}
+
+func (route Route) String() string {
+	return strings.Join(route, " ")
+}
+
+// routeJob returns the job that takes a snapshot of the route to the peer every RouteInterval
+// and records an Event if it differs from the last one
+func routeJob(peer *Peer) *job {
+	maxHops := *peer.MaxHops
+	if maxHops <= 0 {
+		maxHops = DefaultMaxHops
+	}
+	var last Route
+	return &job{
+		interval: time.Duration(*peer.RouteInterval) * time.Millisecond,
+		packets:  maxHops,
+		async:    true,
+		run: func(budget *packetBudget, quit <-chan struct{}) {
+			last = snapshotRoute(peer, maxHops, last, budget, quit)
+		},
+	}
+}
+
+// snapshotRoute takes a snapshot of the route to the peer and records an Event
+// if it differs from the last one, it returns the route to compare the next snapshot with
+func snapshotRoute(peer *Peer, maxHops int, last Route, budget *packetBudget, quit <-chan struct{}) Route {
+	hops, err := traceHops(peer, maxHops, budget, quit)
+	if err == errQuit {
+		return last
+	}
+	if err != nil {
+		log.Printf("Unable to trace the route to %s: %v\n", *peer.Name, err)
+	}
+	// a snapshot that did not reach the peer cannot tell if the route changed
+	route, ok := newRoute(hops)
+	if !ok {
+		return last
+	}
+	if last != nil && !last.Equal(route) {
+		log.Printf("Route to %s changed from %s to %s\n", *peer.Name, last, route)
+		messages.In() <- Event{
+			PeerID: *peer.ID,
+			Time:   hops[0].Time,
+			Type:   EventRouteChanged,
+			Old:    last.String(),
+			New:    route.String(),
+		}
+	}
+	return route.fill(last)
+}
+
+// inferredHops returns the number of hops a reply that arrived with ttl took,
+// assuming the peer used the smallest common initial TTL that is not below ttl
+func inferredHops(ttl int) int {
+	for _, initial := range []int{32, 64, 128, 255} {
+		if ttl <= initial {
+			return initial - ttl
+		}
+	}
+	return 0
+}
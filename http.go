@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// MaxHTTPBodyLength is the number of bytes of a response body that get matched against Match
+const MaxHTTPBodyLength = 1 << 20
+
+// probeHTTP fetches the URL of the peer in the background, the time every phase
+// of the request took gets sent to the collector
+func probeHTTP(peer *Peer) error {
+	request, err := http.NewRequest(http.MethodGet, *peer.Address, nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("User-Agent", "icmpmon")
+
+	// the interface does not depend on the ip version
+	_, iface := peerSource(peer, 4)
+	dialer := net.Dialer{
+		Timeout: time.Duration(*peer.Timeout) * time.Millisecond,
+		Control: dialControl(iface),
+	}
+	if peer.Source != nil && *peer.Source != "" {
+		dialer.LocalAddr = &net.TCPAddr{IP: net.ParseIP(*peer.Source)}
+	}
+	if peer.namespace() != "" {
+		// the connections have to be opened one after another on the thread that joined the namespace
+		dialer.FallbackDelay = -1
+		// the lookup of the hostname of the URL does not run on that thread
+		dialer.Resolver = namespaceResolver(peer.namespace())
+	}
+	client := http.Client{
+		// every request opens a new connection, otherwise the dns, connect and tls phases are skipped
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network string, address string) (conn net.Conn, err error) {
+				err = inNamespace(peer.namespace(), func() (err error) {
+					conn, err = dialer.DialContext(ctx, network, address)
+					return err
+				})
+				return conn, err
+			},
+			DisableKeepAlives: true,
+		},
+		Timeout: time.Duration(*peer.Timeout) * time.Millisecond,
+		// a redirect is the answer of the URL, following it would measure another one
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	go func() {
+		messages.In() <- fetchHTTP(peer, &client, request)
+	}()
+	return nil
+}
+
+// httpPhases are the times the phases of a request started and finished at
+type httpPhases struct {
+	dnsStart, dnsDone, connectStart, connectDone, tlsStart, tlsDone, firstByte time.Time
+	dnsErr, tlsErr                                                             error
+}
+
+// httpTrace records the phases of a request, the transport calls the hooks from its own goroutines,
+// e.g. for the parallel dials of both ip versions or a dial that is still running after the timeout
+type httpTrace struct {
+	sync.Mutex
+	phases httpPhases
+}
+
+func (trace *httpTrace) clientTrace() *httptrace.ClientTrace {
+	record := func(f func(phases *httpPhases)) {
+		trace.Lock()
+		f(&trace.phases)
+		trace.Unlock()
+	}
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) { record(func(p *httpPhases) { p.dnsStart = time.Now() }) },
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			record(func(p *httpPhases) {
+				p.dnsDone = time.Now()
+				p.dnsErr = info.Err
+			})
+		},
+		// with several addresses the connects can overlap, the phase lasts from the first to the last one
+		ConnectStart: func(string, string) {
+			record(func(p *httpPhases) {
+				if p.connectStart.IsZero() {
+					p.connectStart = time.Now()
+				}
+			})
+		},
+		ConnectDone:       func(string, string, error) { record(func(p *httpPhases) { p.connectDone = time.Now() }) },
+		TLSHandshakeStart: func() { record(func(p *httpPhases) { p.tlsStart = time.Now() }) },
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			record(func(p *httpPhases) {
+				p.tlsDone = time.Now()
+				p.tlsErr = err
+			})
+		},
+		GotFirstResponseByte: func() { record(func(p *httpPhases) { p.firstByte = time.Now() }) },
+	}
+}
+
+// snapshot returns a copy of the phases recorded so far
+func (trace *httpTrace) snapshot() httpPhases {
+	trace.Lock()
+	defer trace.Unlock()
+	return trace.phases
+}
+
+// fetchHTTP sends the request of the peer with client and returns its query
+func fetchHTTP(peer *Peer, client *http.Client, request *http.Request) Query {
+	trace := &httpTrace{}
+	sent := time.Now()
+	response, err := client.Do(request.WithContext(httptrace.WithClientTrace(request.Context(), trace.clientTrace())))
+	var body []byte
+	if err == nil {
+		body, err = ioutil.ReadAll(io.LimitReader(response.Body, MaxHTTPBodyLength))
+		response.Body.Close()
+	}
+	received := time.Now()
+	phases := trace.snapshot()
+
+	query := Query{
+		PeerID:        *peer.ID,
+		Time:          received.UTC().UnixNano() / 1000000,
+		ResponseTime:  -1,
+		Outcome:       OutcomeOK,
+		DNSTime:       phaseTime(phases.dnsStart, phases.dnsDone),
+		ConnectTime:   phaseTime(phases.connectStart, phases.connectDone),
+		TLSTime:       phaseTime(phases.tlsStart, phases.tlsDone),
+		FirstByteTime: phaseTime(sent, phases.firstByte),
+	}
+	if response != nil {
+		query.StatusCode = response.StatusCode
+	}
+	switch {
+	case phases.dnsErr != nil:
+		query.Outcome = OutcomeDNSFailed
+		err = phases.dnsErr
+	case phases.tlsErr != nil:
+		query.Outcome = OutcomeTLSFailed
+		err = phases.tlsErr
+	case err != nil:
+		query.Outcome = dialOutcome(err)
+	case !peer.StatusOK(response.StatusCode):
+		query.Outcome = OutcomeBadStatus
+		err = errors.New(response.Status)
+	case peer.match != nil && !peer.match.Match(body):
+		query.Outcome = OutcomeNoMatch
+		err = errors.New("the body does not match")
+	default:
+		query.ResponseTime = float64(received.Sub(sent)) / float64(time.Millisecond)
+	}
+	if err != nil {
+		log.Printf("Got %s for %s (%v)\n", query.Outcome, *peer.Name, err)
+	}
+	return query
+}
+
+// phaseTime returns the Milliseconds from start to done, 0 if the phase did not finish
+func phaseTime(start time.Time, done time.Time) float64 {
+	if start.IsZero() || done.IsZero() {
+		return 0
+	}
+	return float64(done.Sub(start)) / float64(time.Millisecond)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/eapache/channels.v1"
+)
+
+// probeTestPeer probes the peer and returns the query it sent to the collector
+func probeTestPeer(t *testing.T, peer *Peer, probe func(peer *Peer) error) Query {
+	t.Helper()
+	messages = channels.NewRingChannel(16)
+	if err := probe(peer); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case message := <-messages.Out():
+		return message.(Query)
+	case <-time.After(5 * time.Second):
+		t.Fatal("got no query")
+	}
+	return Query{}
+}
+
+func TestProbeHTTP(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ok", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello world")
+	})
+	mux.HandleFunc("/error", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "oops", http.StatusInternalServerError)
+	})
+	mux.HandleFunc("/redirect", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/error", http.StatusFound)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	// the certificate of the test server is not trusted
+	tlsServer := httptest.NewTLSServer(mux)
+	defer tlsServer.Close()
+
+	tests := []struct {
+		name       string
+		peer       string
+		outcome    string
+		statusCode int
+	}{
+		{"ok", `Address: "` + server.URL + `/ok"`, OutcomeOK, 200},
+		{"bad status", `Address: "` + server.URL + `/error"`, OutcomeBadStatus, 500},
+		{"expected status", `Address: "` + server.URL + `/error"` + "\n" + `Status: 500`, OutcomeOK, 500},
+		{"match", `Address: "` + server.URL + `/ok"` + "\n" + `Match: "wor.d"`, OutcomeOK, 200},
+		{"no match", `Address: "` + server.URL + `/ok"` + "\n" + `Match: "^world"`, OutcomeNoMatch, 200},
+		// the redirect is the answer, following it would get the error
+		{"redirect", `Address: "` + server.URL + `/redirect"`, OutcomeOK, 302},
+		{"tls failed", `Address: "` + tlsServer.URL + `/ok"`, OutcomeTLSFailed, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			peers := useTestConfig(t, "{\nPeers: [\n{\nType: http\n"+test.peer+"\n}\n]\n}")
+			query := probeTestPeer(t, &peers[0], probeHTTP)
+			if query.Outcome != test.outcome || query.StatusCode != test.statusCode {
+				t.Fatalf("got %s with status %d, want %s with status %d", query.Outcome, query.StatusCode, test.outcome, test.statusCode)
+			}
+			if (query.ResponseTime >= 0) != (test.outcome == OutcomeOK) {
+				t.Fatalf("got the response time %f for %s", query.ResponseTime, query.Outcome)
+			}
+			if query.ConnectTime <= 0 || (strings.HasPrefix(test.peer, `Address: "https`) && query.TLSTime <= 0) {
+				t.Fatalf("got the connect time %f and the tls time %f", query.ConnectTime, query.TLSTime)
+			}
+		})
+	}
+}
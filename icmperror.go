@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// errorOutcome returns the outcome an ICMP error stands for,
+// it is empty if the message type is not an error
+func errorOutcome(ipVersion int, messageType int, code int) string {
+	if ipVersion == 4 {
+		switch ipv4.ICMPType(messageType) {
+		case ipv4.ICMPTypeDestinationUnreachable:
+			// fragmentation needed and DF set
+			if code == 4 {
+				return OutcomePacketTooBig
+			}
+			return OutcomeUnreachable
+		case ipv4.ICMPTypeTimeExceeded:
+			return OutcomeTimeExceeded
+		case ipv4.ICMPTypeParameterProblem:
+			return OutcomeParameterProblem
+		}
+		return ""
+	}
+	switch ipv6.ICMPType(messageType) {
+	case ipv6.ICMPTypeDestinationUnreachable:
+		return OutcomeUnreachable
+	case ipv6.ICMPTypePacketTooBig:
+		return OutcomePacketTooBig
+	case ipv6.ICMPTypeTimeExceeded:
+		return OutcomeTimeExceeded
+	case ipv6.ICMPTypeParameterProblem:
+		return OutcomeParameterProblem
+	}
+	return ""
+}
+
+// reportedMTU returns the MTU of the next hop a packet too big error reports,
+// data is the whole error message as IPv4 keeps the MTU in the otherwise unused header bytes
+func reportedMTU(message *icmp.Message, data []byte) int {
+	switch body := message.Body.(type) {
+	case *icmp.PacketTooBig:
+		return body.MTU
+	case *icmp.DstUnreach:
+		if len(data) >= 8 {
+			return int(binary.BigEndian.Uint16(data[6:8]))
+		}
+	}
+	return 0
+}
+
+// icmpTypeNumber returns the number of an ICMP message type
+func icmpTypeNumber(messageType icmp.Type) int {
+	switch messageType := messageType.(type) {
+	case ipv4.ICMPType:
+		return int(messageType)
+	case ipv6.ICMPType:
+		return int(messageType)
+	}
+	return -1
+}
+
+// quotedPacket returns the data of an ICMP error message, that is the start
+// of the packet the error was reported for
+func quotedPacket(body icmp.MessageBody) []byte {
+	switch body := body.(type) {
+	case *icmp.DstUnreach:
+		return body.Data
+	case *icmp.TimeExceeded:
+		return body.Data
+	case *icmp.PacketTooBig:
+		return body.Data
+	case *icmp.ParamProb:
+		return body.Data
+	}
+	return nil
+}
+
+// parseQuotedPacket returns the destination and the ICMP message of a packet that
+// was quoted in an ICMP error, message is nil if the packet is not an ICMP packet
+func parseQuotedPacket(ipVersion int, data []byte) (dst net.IP, message []byte) {
+	if ipVersion == 4 {
+		header, err := ipv4.ParseHeader(data)
+		if err != nil || header.Protocol != ProtocolICMP || len(data) < header.Len {
+			return nil, nil
+		}
+		return header.Dst, data[header.Len:]
+	}
+	header, err := ipv6.ParseHeader(data)
+	if err != nil || header.NextHeader != ProtocolIPv6ICMP {
+		return nil, nil
+	}
+	return header.Dst, data[ipv6.HeaderLen:]
+}
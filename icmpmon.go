@@ -24,6 +24,9 @@ import (
 
 	"strings"
 
+	"errors"
+	"syscall"
+
 	"path"
 
 	"golang.org/x/net/icmp"
@@ -35,21 +38,24 @@ import (
 
 //go:generate go-bindata -pkg main -o resources.go index.html app.js config.hjson d3-path.v1.min.js d3-shape.v1.min.js d3-time-format.v2.min.js d3-time.v1.min.js d3.v4.min.js jquery.js metricsgraphics.js vue.min.js metricsgraphics.css style.css
 
-
 const ProtocolICMP = 1
-const ICMPPacketLength = 1500
+const ProtocolIPv6ICMP = 58
+
+// ICMPPacketLength is the size of the read buffer, it fits the biggest echo reply
+const ICMPPacketLength = 65536
 
-var listener4 *icmp.PacketConn
-var listener6 *icmp.PacketConn
+var listener4 *Listener
+var listener6 *Listener
 
 var messages channels.Channel
 var quitChannel *QuitChannel
 
-var requests []Request
-var queryChannel *QueryChannel
+// requests holds the requests that are waiting for a reply, it is only used by the collector
+var requests = map[RequestKey]Request{}
 
-var seqcount = 0
-var lock sync.RWMutex
+// hopCounts holds the hop count of the last echo reply by peer id, it is only used by the collector
+var hopCounts = map[int64]int{}
+var queryChannel *QueryChannel
 
 var configFile string
 var showVersion bool
@@ -61,14 +67,38 @@ var db *DB
 
 var version = "unknown"
 
-func ping(peer *Peer) (err error) {
-	var isIP4 = false
-	var listener = listener6
+func ping(peer *Peer) error {
+	ip := peer.IP()
+	if ip == nil {
+		// hostname was not resolved yet
+		return nil
+	}
 
 	// which listener to use?
-	if peer.ip.To4() != nil {
+	listener := peerListener(peer, ip)
+	if listener == nil {
+		return fmt.Errorf("Unable to ping %s via %s", ip, peer.Path())
+	}
+	// ping sockets can only send echo requests
+	if peer.Timestamps && ip.To4() != nil && listener.Privileged {
+		if err := sendTimestamp(peer, ip, listener); err != nil {
+			log.Printf("Unable to send a timestamp request to %s: %v\n", *peer.Name, err)
+		}
+	}
+	if *peer.Count > 1 {
+		go burst(peer, ip, listener)
+		return nil
+	}
+	return sendEcho(peer, ip, listener, *peer.Size, 0, nil)
+}
+
+// sendEcho sends an echo request with size data bytes and a TTL of ttl (0 for the default) to ip of the peer,
+// if result is not nil the collector sends the query of the request to it
+// instead of storing it
+func sendEcho(peer *Peer, ip net.IP, listener *Listener, size int, ttl int, result chan<- Query) (err error) {
+	var isIP4 = false
+	if ip.To4() != nil {
 		isIP4 = true
-		listener = listener4
 	}
 
 	// build the message
@@ -81,18 +111,15 @@ func ping(peer *Peer) (err error) {
 	}
 	message.Code = 0
 
-	lock.Lock()
-	if seqcount >= 65535 {
-		seqcount = 0
-	}
-	seqcount++
-	var seq = seqcount
-	lock.Unlock()
+	seq := peer.nextSeq()
+	echoID := listener.EchoID()
 
+	now := time.Now()
+	payload := newEchoPayload(peer, size, now)
 	message.Body = &icmp.Echo{
-		ID:   os.Getpid() & 0xffff,
+		ID:   echoID,
 		Seq:  seq,
-		Data: []byte{},
+		Data: payload,
 	}
 
 	// marshal the msssage
@@ -103,35 +130,50 @@ func ping(peer *Peer) (err error) {
 	}
 
 	messages.In() <- Request{
-		ID:   seq,
-		Time: time.Now().UTC().UnixNano() / 1000000,
-		Peer: peer,
+		EchoID:   echoID,
+		Seq:      seq,
+		IP:       ip,
+		Sent:     now,
+		Peer:     peer,
+		Listener: listener,
+		Payload:  payload,
+		Result:   result,
 	}
 
 	// and send
-	_, err = listener.WriteTo(bytes, &net.IPAddr{IP: peer.ip})
+	_, err = listener.WriteToTTL(bytes, ip, ttl)
+	if err != nil {
+		// an ICMP error for an earlier message fails the next send, so try again
+		_, err = listener.WriteToTTL(bytes, ip, ttl)
+	}
 	if err != nil {
+		if listener.DontFragment && errors.Is(err, syscall.EMSGSIZE) {
+			// the request does not even fit the MTU of the local interface
+			messages.In() <- Response{
+				EchoID:   echoID,
+				Seq:      seq,
+				IP:       ip,
+				Received: time.Now(),
+				Listener: listener,
+				Payload:  payload,
+				Outcome:  OutcomePacketTooBig,
+			}
+			return nil
+		}
 		return err
 	}
 
 	return nil
 }
 
-func readListener(listener net.PacketConn, ipVersion int) {
+func readListener(listener *Listener) {
 	// Subscribe to quitChannel
 	quitChannel := quitChannel.Add()
 
 	// recive the reply
 	var bytes []byte
-	var recivedMessage *icmp.Message
-	var err error
-	var expectedMessageType icmp.Type
-	if ipVersion == 4 {
-		expectedMessageType = ipv4.ICMPTypeEchoReply
-	} else if ipVersion == 6 {
-		expectedMessageType = ipv6.ICMPTypeEchoReply
-	} else {
-		panic(fmt.Errorf("Unknown IpVersion %d", ipVersion))
+	if listener.IPVersion != 4 && listener.IPVersion != 6 {
+		panic(fmt.Errorf("Unknown IpVersion %d", listener.IPVersion))
 	}
 
 	bytes = make([]byte, ICMPPacketLength)
@@ -139,12 +181,13 @@ func readListener(listener net.PacketConn, ipVersion int) {
 		type st struct {
 			byteCount int
 			remote    net.Addr
+			info      PacketInfo
 			err       error
 		}
 		ch := make(chan st, 1)
 		go func(bytes []byte) {
 			var result st
-			result.byteCount, result.remote, result.err = listener.ReadFrom(bytes)
+			result.byteCount, result.remote, result.info, result.err = listener.ReadMessage(bytes)
 			ch <- result
 		}(bytes)
 		select {
@@ -155,22 +198,94 @@ func readListener(listener net.PacketConn, ipVersion int) {
 			if r.err != nil {
 				continue
 			}
-			recivedMessage, err = icmp.ParseMessage(ProtocolICMP, bytes[:r.byteCount])
-			if err != nil {
-				continue
-			}
+			handleMessage(listener, bytes[:r.byteCount], r.remote, r.info)
+		}
 
-			if recivedMessage.Type == expectedMessageType {
-				messages.In() <- Response{
-					ID:   recivedMessage.Body.(*icmp.Echo).Seq,
-					IP:   net.ParseIP(r.remote.String()),
-					Time: time.Now().UTC().UnixNano() / 1000000,
-				}
+	}
+}
+
+// handleMessage passes echo replies and ICMP errors for echo requests
+// that were read from the listener to the collector
+func handleMessage(listener *Listener, bytes []byte, remote net.Addr, info PacketInfo) {
+	var expectedMessageType icmp.Type = ipv4.ICMPTypeEchoReply
+	if listener.IPVersion == 6 {
+		expectedMessageType = ipv6.ICMPTypeEchoReply
+	}
+
+	response := Response{
+		IP:       addrIP(remote),
+		Listener: listener,
+		Received: info.Received,
+		Outcome:  OutcomeOK,
+	}
+	// the echo request or reply
+	var echoMessage []byte
+	if info.Error != nil {
+		// ping sockets read the request the error was reported for
+		response.Outcome = errorOutcome(listener.IPVersion, info.Error.Type, info.Error.Code)
+		response.Code = info.Error.Code
+		response.Reporter = info.Error.Reporter
+		if response.Outcome == OutcomePacketTooBig {
+			response.MTU = info.Error.Info
+		}
+		echoMessage = bytes
+		expectedMessageType = ipv4.ICMPTypeEcho
+		if listener.IPVersion == 6 {
+			expectedMessageType = ipv6.ICMPTypeEchoRequest
+		}
+	} else {
+		recivedMessage, err := icmp.ParseMessage(listener.Protocol(), bytes)
+		if err != nil {
+			return
+		}
+		if recivedMessage.Type == ipv4.ICMPTypeTimestampReply {
+			timestampResponse, err := parseTimestampReply(recivedMessage)
+			if err != nil || timestampResponse.EchoID != listener.EchoID() {
+				return
 			}
-			//return 0, fmt.Errorf("Got invalid response type: %d, message was: %v", recivedMessage.Type, recivedMessage)
+			timestampResponse.IP = response.IP
+			timestampResponse.Listener = listener
+			timestampResponse.Received = response.Received
+			timestampResponse.Outcome = OutcomeOK
+			messages.In() <- timestampResponse
+			return
 		}
+		if recivedMessage.Type == expectedMessageType {
+			echoMessage = bytes
+			response.TTL = info.TTL
+		} else {
+			response.Outcome = errorOutcome(listener.IPVersion, icmpTypeNumber(recivedMessage.Type), recivedMessage.Code)
+			response.Code = recivedMessage.Code
+			response.Reporter = response.IP
+			if response.Outcome == OutcomePacketTooBig {
+				response.MTU = reportedMTU(recivedMessage, bytes)
+			}
+			// the destination of the quoted request is the ip of the peer
+			response.IP, echoMessage = parseQuotedPacket(listener.IPVersion, quotedPacket(recivedMessage.Body))
+			if listener.IPVersion == 4 {
+				expectedMessageType = ipv4.ICMPTypeEcho
+			} else {
+				expectedMessageType = ipv6.ICMPTypeEchoRequest
+			}
+		}
+	}
+	if response.Outcome == "" || echoMessage == nil {
+		return
+	}
 
+	message, err := icmp.ParseMessage(listener.Protocol(), echoMessage)
+	if err != nil || message.Type != expectedMessageType {
+		return
 	}
+	echo, ok := message.Body.(*icmp.Echo)
+	// raw sockets also receive the replies (and errors) of other processes
+	if !ok || echo.ID != listener.EchoID() {
+		return
+	}
+	response.EchoID = echo.ID
+	response.Seq = echo.Seq
+	response.Payload = echo.Data
+	messages.In() <- response
 }
 
 // collector collects all requests (sent by ping) and puts them in a list
@@ -187,42 +302,135 @@ func collector() {
 		case message := <-messages.Out():
 			switch message.(type) {
 			case Request:
-				requests = append(requests, message.(Request))
+				request := message.(Request)
+				requests[request.Key()] = request
+			case Query:
+				// probes that measure the response time themselves
+				query := message.(Query)
+				recordQuery(&query)
+				queryChannel.Push(query)
+				db.Create(&query)
+			case Event:
+				event := message.(Event)
+				db.Create(&event)
+			case PathMTU:
+				pathMTU := message.(PathMTU)
+				db.Create(&pathMTU)
+			case Hop:
+				hop := message.(Hop)
+				db.Create(&hop)
 			case Response:
+				response := message.(Response)
 				// find the matching request
-				for i := len(requests) - 1; i >= 0; i-- {
-					response := message.(Response)
-					if requests[i].ID == response.ID {
-						// add the query
-						query := Query{
-							PeerID:       *requests[i].Peer.ID,
-							Time:         response.Time,
-							ResponseTime: (response.Time - requests[i].Time),
+				request, ok := findRequest(&response)
+				if !ok {
+					// not ours, a duplicate or the request timed out already
+					if request, ok := duplicateReply(&response); ok && request.Result == nil {
+						log.Printf("Got duplicate reply for %s\n", *request.Peer.Name)
+					}
+					continue
+				}
+				if request.Timestamp {
+					delete(requests, request.Key())
+					if sample, ok := clockSample(&request, &response); ok {
+						db.Create(&sample)
+					}
+					continue
+				}
+				if reason := validateReply(&request, &response); reason != "" {
+					// keep the request, the real reply might still arrive
+					invalidReply := InvalidReply{
+						PeerID: *request.Peer.ID,
+						Time:   response.Received.UTC().UnixNano() / 1000000,
+						IP:     response.IP.String(),
+						Reason: reason,
+					}
+					log.Printf("Got invalid reply for %s from %s (%s)\n", *request.Peer.Name, invalidReply.IP, reason)
+					db.Create(&invalidReply)
+					continue
+				}
+				if response.Outcome != OutcomeOK {
+					// add the query
+					query := Query{
+						PeerID:       *request.Peer.ID,
+						Time:         response.Received.UTC().UnixNano() / 1000000,
+						ResponseTime: -1,
+						Outcome:      response.Outcome,
+						Code:         response.Code,
+						MTU:          response.MTU,
+					}
+					if request.Result != nil {
+						// probes need the time the error took, e.g. the time to a hop
+						query.ResponseTime = float64(response.Received.Sub(request.Sent)) / float64(time.Millisecond)
+					}
+					reporter := "local host"
+					if response.Reporter != nil {
+						query.Reporter = response.Reporter.String()
+						reporter = query.Reporter
+					}
+					if request.Result == nil {
+						log.Printf("Got %s for %s from %s\n", query.Outcome, *request.Peer.Name, reporter)
+					}
+					finishRequest(&request, query)
+					continue
+				}
+				// add the query
+				query := Query{
+					PeerID:       *request.Peer.ID,
+					Time:         response.Received.UTC().UnixNano() / 1000000,
+					ResponseTime: float64(response.Received.Sub(request.Sent)) / float64(time.Millisecond),
+					Outcome:      OutcomeOK,
+					TTL:          response.TTL,
+				}
+				if response.TTL > 0 {
+					hops := inferredHops(response.TTL)
+					if last, ok := hopCounts[query.PeerID]; ok && last != hops {
+						event := Event{
+							PeerID: query.PeerID,
+							Time:   query.Time,
+							Type:   EventHopCountChanged,
+							Old:    strconv.Itoa(last),
+							New:    strconv.Itoa(hops),
 						}
-						//log.Printf("Got Response for %s (%dms)\n", *requests[i].Peer.Name, query.ResponseTime)
-						queryChannel.Push(query)
-						// remove the request
-						requests = append(requests[:i], requests[i+1:]...)
-						db.Create(&query)
-						break
+						log.Printf("Hop count of %s changed from %s to %s\n", *request.Peer.Name, event.Old, event.New)
+						db.Create(&event)
 					}
+					hopCounts[query.PeerID] = hops
 				}
+				if history(query.PeerID).answer(&request) {
+					query.Reordered = true
+					log.Printf("Got reordered reply for %s\n", *request.Peer.Name)
+				}
+				if !payloadIntact(&request, &response) {
+					query.Outcome = OutcomeCorrupted
+					log.Printf("Got corrupted reply for %s\n", *request.Peer.Name)
+				}
+				//log.Printf("Got Response for %s (%.3fms)\n", *request.Peer.Name, query.ResponseTime)
+				finishRequest(&request, query)
 			}
 		case <-timeoutTicker.C:
-			var now = time.Now().UTC().Unix() * 1000
-			for i := len(requests) - 1; i >= 0; i-- {
-				if requests[i].Time+int64(*requests[i].Peer.Timeout) > now {
+			var now = time.Now()
+			for _, h := range replyHistories {
+				h.expire(now)
+			}
+			for _, request := range requests {
+				if now.Sub(request.Sent) >= time.Duration(*request.Peer.Timeout)*time.Millisecond {
+					if request.Timestamp {
+						// the echo request already counts the loss
+						delete(requests, request.Key())
+						continue
+					}
 					// add the query
 					query := Query{
-						PeerID:       *requests[i].Peer.ID,
-						Time:         time.Now().UTC().UnixNano() / 1000000,
+						PeerID:       *request.Peer.ID,
+						Time:         now.UTC().UnixNano() / 1000000,
 						ResponseTime: -1,
+						Outcome:      OutcomeTimeout,
+					}
+					if request.Result == nil {
+						log.Printf("Got Timeout for %s\n", *request.Peer.Name)
 					}
-					log.Printf("Got Timeout for %s\n", *requests[i].Peer.Name)
-					queryChannel.Push(query)
-					// remove the request
-					requests = append(requests[:i], requests[i+1:]...)
-					db.Create(&query)
+					finishRequest(&request, query)
 				}
 			}
 		case <-cleanupTicker.C:
@@ -234,6 +442,45 @@ func collector() {
 	}
 }
 
+// finishRequest removes the request and stores its query,
+// requests with a Result get their query sent to it instead
+func finishRequest(request *Request, query Query) {
+	delete(requests, request.Key())
+	if request.Result != nil {
+		// nobody might be waiting anymore
+		select {
+		case request.Result <- query:
+		default:
+		}
+		return
+	}
+	recordQuery(&query)
+	queryChannel.Push(query)
+	db.Create(&query)
+}
+
+// findRequest returns the pending request response belongs to.
+// Replies that were not sent by this process are matched by their sequence number and source,
+// so they can be counted as invalid replies of the peer.
+func findRequest(response *Response) (Request, bool) {
+	if peerID, ok := echoPayloadPeer(response.Payload); ok {
+		request, ok := requests[RequestKey{PeerID: peerID, EchoID: response.EchoID, Seq: response.Seq}]
+		// a raw socket without interface also receives the replies
+		// that were sent through other listeners
+		if ok && request.Listener == response.Listener {
+			return request, true
+		}
+		return Request{}, false
+	}
+	for _, request := range requests {
+		if request.EchoID == response.EchoID && request.Seq == response.Seq &&
+			request.Listener == response.Listener && request.IP.Equal(response.IP) {
+			return request, true
+		}
+	}
+	return Request{}, false
+}
+
 func cleanup() error {
 	var err error
 	now := time.Now().UTC()
@@ -243,27 +490,42 @@ func cleanup() error {
 	if err != nil {
 		return err
 	}
+	err = db.Delete(&Event{}, "time < ?", now.Add(-config.KeepHistoryFor).Unix()*1000).Error
+	if err != nil {
+		return err
+	}
+	err = db.Delete(&InvalidReply{}, "time < ?", now.Add(-config.KeepHistoryFor).Unix()*1000).Error
+	if err != nil {
+		return err
+	}
+	err = db.Delete(&PathMTU{}, "time < ?", now.Add(-config.KeepHistoryFor).Unix()*1000).Error
+	if err != nil {
+		return err
+	}
+	err = db.Delete(&Hop{}, "time < ?", now.Add(-config.KeepHistoryFor).Unix()*1000).Error
+	if err != nil {
+		return err
+	}
+	err = db.Delete(&ClockSample{}, "time < ?", now.Add(-config.KeepHistoryFor).Unix()*1000).Error
+	if err != nil {
+		return err
+	}
 	return nil
 }
 
-func pingRoutine(peer Peer) {
-	interval, _ := time.ParseDuration(fmt.Sprintf("%dms", *peer.Interval))
-	// Subscribe to quitChannel
-	quitChannel := quitChannel.Add()
-	ticker := time.NewTicker(interval)
-	for {
-		err := ping(&peer)
-		if err != nil {
-			log.Panic(err)
-		}
-		select {
-		case <-quitChannel:
-			quitChannel <- true
-			return
-		case <-ticker.C:
-			continue
-		}
+// probe sends a probe of the type of the peer
+func probe(peer *Peer) error {
+	switch *peer.Type {
+	case PeerTypeTCP:
+		return probeTCP(peer)
+	case PeerTypeHTTP:
+		return probeHTTP(peer)
+	case PeerTypeDNS:
+		return probeDNS(peer)
+	case PeerTypeARP:
+		return probeARP(peer)
 	}
+	return ping(peer)
 }
 
 func liveDataHandler(ws *websocket.Conn) {
@@ -361,9 +623,9 @@ func dataHandler(w http.ResponseWriter, req *http.Request) {
 			stop = start
 			start = i
 		}
-		err = db.Select("response_time, time").Where("peer_id = ? AND time >= ? AND time <= ?", peerID, start, stop).Order("time").Find(&queries).Error
+		err = db.Select("response_time, time, outcome, code, reporter, mtu, ttl, dns_time, connect_time, tls_time, first_byte_time, status_code, rcode, answers, forward_loss, backward_loss, reordered, forward_delay_variation, backward_delay_variation, sent, loss, min_response_time, max_response_time, std_dev, jitter, interarrival_jitter, duplicates, r_factor, mos, hardware_addr").Where("peer_id = ? AND time >= ? AND time <= ?", peerID, start, stop).Order("time").Find(&queries).Error
 	} else {
-		err = db.Select("response_time, time").Where("peer_id = ?", peerID).Order("time").Find(&queries).Error
+		err = db.Select("response_time, time, outcome, code, reporter, mtu, ttl, dns_time, connect_time, tls_time, first_byte_time, status_code, rcode, answers, forward_loss, backward_loss, reordered, forward_delay_variation, backward_delay_variation, sent, loss, min_response_time, max_response_time, std_dev, jitter, interarrival_jitter, duplicates, r_factor, mos, hardware_addr").Where("peer_id = ?", peerID).Order("time").Find(&queries).Error
 	}
 	if err != nil {
 		log.Printf("Unable to get data: %v\n", err)
@@ -380,14 +642,14 @@ func dataHandler(w http.ResponseWriter, req *http.Request) {
 		if diff > interval {
 			queries = append(queries, Query{})
 			copy(queries[1:], queries[:l-1])
-			queries[0] = Query{PeerID: peerID, Time: start + interval, ResponseTime: 0}
+			queries[0] = Query{PeerID: peerID, Time: start + interval, ResponseTime: -1, Outcome: OutcomeNoData}
 			l++
 		}
 
 		// append data point if end is too far away
 		diff = queries[l-1].Time - stop - tolerance
 		if diff > interval {
-			queries = append(queries, Query{PeerID: peerID, Time: stop - interval, ResponseTime: 0})
+			queries = append(queries, Query{PeerID: peerID, Time: stop - interval, ResponseTime: -1, Outcome: OutcomeNoData})
 			l++
 		}
 
@@ -399,7 +661,7 @@ func dataHandler(w http.ResponseWriter, req *http.Request) {
 				if diff > interval {
 					queries = append(queries, Query{})
 					copy(queries[i+1:], queries[i:])
-					queries[i] = Query{PeerID: peerID, Time: previousQuery.Time + interval, ResponseTime: 0}
+					queries[i] = Query{PeerID: peerID, Time: previousQuery.Time + interval, ResponseTime: -1, Outcome: OutcomeNoData}
 					l++
 				}
 			}
@@ -410,7 +672,7 @@ func dataHandler(w http.ResponseWriter, req *http.Request) {
 		if l == 0 {
 			queries = make([]Query, max)
 			for i := 0; i < max; i++ {
-				queries[i] = Query{PeerID: peerID, Time: start + interval*int64(i), ResponseTime: 0}
+				queries[i] = Query{PeerID: peerID, Time: start + interval*int64(i), ResponseTime: -1, Outcome: OutcomeNoData}
 			}
 			encoder.Encode(queries)
 		} else if l > max {
@@ -478,37 +740,407 @@ func statsHandler(w http.ResponseWriter, req *http.Request) {
 
 	var averageTime float64
 	var uptime float64
+	var invalidReplies int64
 	var result Result
 	if start > 0 && stop > 0 {
-		err = db.Raw("SELECT AVG(response_time) AS  f FROM queries WHERE peer_id = ? AND time >= ? AND time <= ? AND response_time > 0", peerID, start, stop).Scan(&result).Error
+		err = db.Model(&InvalidReply{}).Where("peer_id = ? AND time >= ? AND time <= ?", peerID, start, stop).Count(&invalidReplies).Error
+		if err != nil {
+			log.Printf("Unable to get stats: %v\n", err)
+		}
+		err = db.Raw("SELECT AVG(response_time) AS  f FROM queries WHERE peer_id = ? AND time >= ? AND time <= ? AND response_time >= 0", peerID, start, stop).Scan(&result).Error
 		if err != nil {
 			log.Printf("Unable to get stats: %v\n", err)
 		}
 		averageTime = result.F
-		err = db.Raw("SELECT COUNT(response_time) * 100 / (SELECT COUNT(response_time) FROM queries WHERE peer_id = ? AND time >= ? AND time <= ?) AS f FROM queries WHERE peer_id = ? AND time >= ? AND time <= ? AND response_time > 0", peerID, start, stop, peerID, start, stop).Scan(&result).Error
+		err = db.Raw("SELECT COUNT(response_time) * 100 / (SELECT COUNT(response_time) FROM queries WHERE peer_id = ? AND time >= ? AND time <= ?) AS f FROM queries WHERE peer_id = ? AND time >= ? AND time <= ? AND response_time >= 0", peerID, start, stop, peerID, start, stop).Scan(&result).Error
 		uptime = result.F
 	} else {
-		err = db.Raw("SELECT AVG(response_time) AS f FROM queries WHERE peer_id = ? AND response_time > 0", peerID).Scan(&result).Error
+		err = db.Model(&InvalidReply{}).Where("peer_id = ?", peerID).Count(&invalidReplies).Error
+		if err != nil {
+			log.Printf("Unable to get stats: %v\n", err)
+		}
+		err = db.Raw("SELECT AVG(response_time) AS f FROM queries WHERE peer_id = ? AND response_time >= 0", peerID).Scan(&result).Error
 		if err != nil {
 			log.Printf("Unable to get stats: %v\n", err)
 		}
 		averageTime = result.F
-		err = db.Raw("SELECT COUNT(response_time) * 100 / (SELECT COUNT(response_time) FROM queries WHERE peer_id = ?) AS f FROM queries WHERE peer_id = ? AND response_time > 0", peerID, peerID).Scan(&result).Error
+		err = db.Raw("SELECT COUNT(response_time) * 100 / (SELECT COUNT(response_time) FROM queries WHERE peer_id = ?) AS f FROM queries WHERE peer_id = ? AND response_time >= 0", peerID, peerID).Scan(&result).Error
 		uptime = result.F
 	}
 	if err != nil {
 		log.Printf("Unable to get stats: %v\n", err)
 	}
+
+	// count the queries by their outcome
+	var outcomeCounts []struct {
+		Outcome string
+		Count   int64
+	}
+	scope := db.Model(&Query{}).Select("outcome, COUNT(*) AS count").Where("peer_id = ?", peerID)
+	if start > 0 && stop > 0 {
+		scope = scope.Where("time >= ? AND time <= ?", start, stop)
+	}
+	err = scope.Group("outcome").Scan(&outcomeCounts).Error
+	if err != nil {
+		log.Printf("Unable to get stats: %v\n", err)
+	}
+	outcomes := map[string]int64{}
+	for _, outcomeCount := range outcomeCounts {
+		outcomes[outcomeCount.Outcome] = outcomeCount.Count
+	}
+
+	// the loss in each direction of the test packets of udp peers and the reordered replies
+	var udpStats struct {
+		ForwardLoss  float64
+		BackwardLoss float64
+		Reordered    int64
+	}
+	scope = db.Model(&Query{}).Select("COALESCE(SUM(forward_loss) * 100.0 / COUNT(*), 0) AS forward_loss, COALESCE(SUM(backward_loss) * 100.0 / COUNT(*), 0) AS backward_loss, COALESCE(SUM(reordered), 0) AS reordered").Where("peer_id = ?", peerID)
+	if start > 0 && stop > 0 {
+		scope = scope.Where("time >= ? AND time <= ?", start, stop)
+	}
+	err = scope.Scan(&udpStats).Error
+	if err != nil {
+		log.Printf("Unable to get stats: %v\n", err)
+	}
+
+	// the average loss and jitter of bursts
+	var burstStats struct {
+		Loss   float64
+		Jitter float64
+	}
+	scope = db.Model(&Query{}).Select("COALESCE(AVG(loss), 0) AS loss, COALESCE(AVG(CASE WHEN response_time >= 0 THEN jitter END), 0) AS jitter").Where("peer_id = ? AND sent > 0", peerID)
+	if start > 0 && stop > 0 {
+		scope = scope.Where("time >= ? AND time <= ?", start, stop)
+	}
+	err = scope.Scan(&burstStats).Error
+	if err != nil {
+		log.Printf("Unable to get stats: %v\n", err)
+	}
+
+	// the interarrival jitter and the duplicate replies
+	var replyStats struct {
+		InterarrivalJitter float64
+		Duplicates         int64
+	}
+	scope = db.Model(&Query{}).Select("COALESCE(AVG(CASE WHEN response_time >= 0 THEN interarrival_jitter END), 0) AS interarrival_jitter, COALESCE(SUM(duplicates), 0) AS duplicates").Where("peer_id = ?", peerID)
+	if start > 0 && stop > 0 {
+		scope = scope.Where("time >= ? AND time <= ?", start, stop)
+	}
+	err = scope.Scan(&replyStats).Error
+	if err != nil {
+		log.Printf("Unable to get stats: %v\n", err)
+	}
+
+	// the rating of a call over the path with the averages of the window
+	var rating, mos float64
+	if peer := peerByID(int64(peerID)); peer != nil && peer.ratesCalls() && len(outcomes) > 0 {
+		var callStats struct {
+			ResponseTime float64
+			Jitter       float64
+			Loss         float64
+		}
+		scope = db.Model(&Query{}).Select("COALESCE(AVG(CASE WHEN response_time >= 0 THEN response_time END), -1) AS response_time, COALESCE(AVG(CASE WHEN response_time >= 0 THEN (CASE WHEN sent > 0 THEN jitter ELSE interarrival_jitter END) END), 0) AS jitter, COALESCE(AVG(CASE WHEN sent > 0 THEN loss WHEN response_time >= 0 THEN 0 ELSE 100 END), 0) AS loss").Where("peer_id = ?", peerID)
+		if start > 0 && stop > 0 {
+			scope = scope.Where("time >= ? AND time <= ?", start, stop)
+		}
+		err = scope.Scan(&callStats).Error
+		if err != nil {
+			log.Printf("Unable to get stats: %v\n", err)
+		}
+		if callStats.ResponseTime >= 0 {
+			rating = rFactor(callStats.ResponseTime/2, callStats.Jitter, callStats.Loss)
+		}
+		mos = meanOpinionScore(rating)
+	}
+
 	type st struct {
 		AverageResponseTime float64
 		Uptime              float64
+		// InvalidReplies is the number of replies that did not match their request
+		InvalidReplies int64
+		// Outcomes is the number of queries by their outcome
+		Outcomes map[string]int64
+		// ForwardLoss and BackwardLoss are the percentages of test packets lost in each direction
+		ForwardLoss  float64 `json:",omitempty"`
+		BackwardLoss float64 `json:",omitempty"`
+		// Reordered is the number of replies that arrived out of order
+		Reordered int64 `json:",omitempty"`
+		// Loss is the average percentage of lost echo requests of a burst
+		Loss float64 `json:",omitempty"`
+		// Jitter is the average jitter of the bursts in Milliseconds
+		Jitter float64 `json:",omitempty"`
+		// InterarrivalJitter is the average jitter estimate of RFC 3550 in Milliseconds
+		InterarrivalJitter float64 `json:",omitempty"`
+		// Duplicates is the number of duplicate echo replies
+		Duplicates int64 `json:",omitempty"`
+		// RFactor and MOS rate a call with the average response time, jitter and loss
+		RFactor float64 `json:",omitempty"`
+		MOS     float64 `json:",omitempty"`
 	}
 	encoder.Encode(&st{
 		AverageResponseTime: averageTime,
 		Uptime:              uptime,
+		InvalidReplies:      invalidReplies,
+		Outcomes:            outcomes,
+		ForwardLoss:         udpStats.ForwardLoss,
+		BackwardLoss:        udpStats.BackwardLoss,
+		Reordered:           udpStats.Reordered,
+		Loss:                burstStats.Loss,
+		Jitter:              burstStats.Jitter,
+		InterarrivalJitter:  replyStats.InterarrivalJitter,
+		Duplicates:          replyStats.Duplicates,
+		RFactor:             rating,
+		MOS:                 mos,
 	})
 }
 
+func eventsHandler(w http.ResponseWriter, req *http.Request) {
+	var peerID int64
+	var start int64 = -1
+	var stop int64 = -1
+	var err error
+	var str string
+
+	str = req.URL.Query().Get("peer")
+	peerID, err = strconv.ParseInt(str, 10, 0)
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+
+	str = req.URL.Query().Get("start")
+	if len(str) > 0 {
+		start, err = strconv.ParseInt(str, 10, 0)
+		if err != nil {
+			w.WriteHeader(400)
+			return
+		}
+	}
+	str = req.URL.Query().Get("stop")
+	if len(str) > 0 {
+		stop, err = strconv.ParseInt(str, 10, 0)
+		if err != nil {
+			w.WriteHeader(400)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	events := []Event{}
+	if start >= 0 && stop >= 0 {
+		if start > stop {
+			start, stop = stop, start
+		}
+		err = db.Where("peer_id = ? AND time >= ? AND time <= ?", peerID, start, stop).Order("time").Find(&events).Error
+	} else {
+		err = db.Where("peer_id = ?", peerID).Order("time").Find(&events).Error
+	}
+	if err != nil {
+		log.Printf("Unable to get events: %v\n", err)
+	}
+	encoder.Encode(events)
+}
+
+func mtuHandler(w http.ResponseWriter, req *http.Request) {
+	var peerID int64
+	var start int64 = -1
+	var stop int64 = -1
+	var err error
+	var str string
+
+	str = req.URL.Query().Get("peer")
+	peerID, err = strconv.ParseInt(str, 10, 0)
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+
+	str = req.URL.Query().Get("start")
+	if len(str) > 0 {
+		start, err = strconv.ParseInt(str, 10, 0)
+		if err != nil {
+			w.WriteHeader(400)
+			return
+		}
+	}
+	str = req.URL.Query().Get("stop")
+	if len(str) > 0 {
+		stop, err = strconv.ParseInt(str, 10, 0)
+		if err != nil {
+			w.WriteHeader(400)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	pathMTUs := []PathMTU{}
+	if start >= 0 && stop >= 0 {
+		if start > stop {
+			start, stop = stop, start
+		}
+		err = db.Where("peer_id = ? AND time >= ? AND time <= ?", peerID, start, stop).Order("time").Find(&pathMTUs).Error
+	} else {
+		err = db.Where("peer_id = ?", peerID).Order("time").Find(&pathMTUs).Error
+	}
+	if err != nil {
+		log.Printf("Unable to get path MTUs: %v\n", err)
+	}
+	encoder.Encode(pathMTUs)
+}
+
+func clockHandler(w http.ResponseWriter, req *http.Request) {
+	var peerID int64
+	var start int64 = -1
+	var stop int64 = -1
+	var err error
+	var str string
+
+	str = req.URL.Query().Get("peer")
+	peerID, err = strconv.ParseInt(str, 10, 0)
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+
+	str = req.URL.Query().Get("start")
+	if len(str) > 0 {
+		start, err = strconv.ParseInt(str, 10, 0)
+		if err != nil {
+			w.WriteHeader(400)
+			return
+		}
+	}
+	str = req.URL.Query().Get("stop")
+	if len(str) > 0 {
+		stop, err = strconv.ParseInt(str, 10, 0)
+		if err != nil {
+			w.WriteHeader(400)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	samples := []ClockSample{}
+	if start >= 0 && stop >= 0 {
+		if start > stop {
+			start, stop = stop, start
+		}
+		err = db.Where("peer_id = ? AND time >= ? AND time <= ?", peerID, start, stop).Order("time").Find(&samples).Error
+	} else {
+		err = db.Where("peer_id = ?", peerID).Order("time").Find(&samples).Error
+	}
+	if err != nil {
+		log.Printf("Unable to get clock samples: %v\n", err)
+	}
+	encoder.Encode(samples)
+}
+
+func hopsHandler(w http.ResponseWriter, req *http.Request) {
+	var peerID int64
+	var start int64 = -1
+	var stop int64 = -1
+	var ttl = -1
+	var err error
+	var str string
+
+	str = req.URL.Query().Get("peer")
+	peerID, err = strconv.ParseInt(str, 10, 0)
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+
+	str = req.URL.Query().Get("start")
+	if len(str) > 0 {
+		start, err = strconv.ParseInt(str, 10, 0)
+		if err != nil {
+			w.WriteHeader(400)
+			return
+		}
+	}
+	str = req.URL.Query().Get("stop")
+	if len(str) > 0 {
+		stop, err = strconv.ParseInt(str, 10, 0)
+		if err != nil {
+			w.WriteHeader(400)
+			return
+		}
+	}
+	str = req.URL.Query().Get("ttl")
+	if len(str) > 0 {
+		ttl, err = strconv.Atoi(str)
+		if err != nil {
+			w.WriteHeader(400)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	scope := db.Where("peer_id = ?", peerID)
+	if start >= 0 && stop >= 0 {
+		if start > stop {
+			start, stop = stop, start
+		}
+		scope = scope.Where("time >= ? AND time <= ?", start, stop)
+	}
+
+	// the series of a single hop
+	if ttl >= 0 {
+		hops := []Hop{}
+		err = scope.Where("ttl = ?", ttl).Order("time").Find(&hops).Error
+		if err != nil {
+			log.Printf("Unable to get hops: %v\n", err)
+		}
+		encoder.Encode(hops)
+		return
+	}
+
+	// the hop table
+	type HopStats struct {
+		TTL int
+		// Hosts are the addresses that replied for this hop
+		Hosts []string
+		Sent  int64
+		// Loss is in percent
+		Loss    float64
+		Average float64
+		Best    float64
+		Worst   float64
+	}
+	table := []HopStats{}
+	rows, err := scope.Model(&Hop{}).Select(`ttl, COALESCE(GROUP_CONCAT(DISTINCT NULLIF(ip, '')), ''), COUNT(*),
+		SUM(CASE WHEN response_time < 0 THEN 1 ELSE 0 END) * 100.0 / COUNT(*),
+		COALESCE(AVG(CASE WHEN response_time >= 0 THEN response_time END), -1),
+		COALESCE(MIN(CASE WHEN response_time >= 0 THEN response_time END), -1),
+		MAX(response_time)`).Group("ttl").Order("ttl").Rows()
+	if err != nil {
+		log.Printf("Unable to get hops: %v\n", err)
+		encoder.Encode(table)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var hopStats HopStats
+		var hosts string
+		err = rows.Scan(&hopStats.TTL, &hosts, &hopStats.Sent, &hopStats.Loss, &hopStats.Average, &hopStats.Best, &hopStats.Worst)
+		if err != nil {
+			log.Printf("Unable to get hops: %v\n", err)
+			break
+		}
+		hopStats.Hosts = []string{}
+		if hosts != "" {
+			hopStats.Hosts = strings.Split(hosts, ",")
+		}
+		table = append(table, hopStats)
+	}
+	encoder.Encode(table)
+}
+
 func peersHandler(w http.ResponseWriter, req *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
@@ -552,6 +1184,10 @@ func webServer(addr string) {
 	serveMux.HandleFunc("/data", dataHandler)
 	serveMux.HandleFunc("/stats", statsHandler)
 	serveMux.HandleFunc("/peers", peersHandler)
+	serveMux.HandleFunc("/events", eventsHandler)
+	serveMux.HandleFunc("/mtu", mtuHandler)
+	serveMux.HandleFunc("/hops", hopsHandler)
+	serveMux.HandleFunc("/clock", clockHandler)
 	serveMux.Handle("/livedata", websocket.Handler(liveDataHandler))
 
 	server.Handler = serveMux
@@ -583,12 +1219,16 @@ func main() {
 	var err error
 	flag.Parse()
 
+	if len(flag.Args()) > 0 && flag.Arg(0) == "reflect" {
+		os.Exit(reflectCommand(flag.Args()[1:]))
+	}
 	if showVersion || (len(flag.Args()) > 0 && flag.Arg(0) == "version") {
 		fmt.Printf("icmpmon %s\n", version)
 		os.Exit(0)
 	}
 	if len(configFile) <= 0 || showHelp || (len(flag.Args()) > 0 && flag.Arg(0) == "help") {
 		fmt.Printf("usage: %s [-c config.hjson]\n", filepath.Base(os.Args[0]))
+		fmt.Printf("       %s reflect [-listen :%d]\n", filepath.Base(os.Args[0]), TWAMPPort)
 		if len(configFile) <= 0 {
 			os.Exit(1)
 		} else {
@@ -613,20 +1253,31 @@ func main() {
 		log.Fatal(err)
 	}
 
-	// if linux
-	//sysctl -w net.ipv4.ping_group_range="0 0"
+	// unprivileged mode needs (on linux)
+	//sysctl -w net.ipv4.ping_group_range="0 2147483647"
 
-	listener4, err = icmp.ListenPacket("ip4:icmp", "0.0.0.0")
+	listener4, err = openListener(4, *config.SourceIPv4, *config.Interface, false, 0, *config.Namespace)
 	if err != nil {
 		log.Fatalf("listen err, %s", err)
 	}
-	defer listener4.Close()
 
-	listener6, err = icmp.ListenPacket("ip6:icmp", "::1")
+	listener6, err = openListener(6, *config.SourceIPv6, *config.Interface, false, 0, *config.Namespace)
 	if err != nil {
 		log.Fatalf("listen err, %s", err)
 	}
-	defer listener6.Close()
+
+	// every distinct source of the peers gets its own listener
+	for i := range config.Peers {
+		if err = openPeerListeners(&config.Peers[i]); err != nil {
+			log.Fatalf("listen err, %s", err)
+		}
+		if listener := peerListener(&config.Peers[i], net.IPv4zero); config.Peers[i].Timestamps && listener != nil && !listener.Privileged {
+			log.Printf("%s gets no ICMP timestamps, they need a raw socket\n", *config.Peers[i].Name)
+		}
+	}
+	for _, listener := range listeners {
+		defer listener.Close()
+	}
 	quitChannel = NewQuitChannel()
 	queryChannel = NewQueryChannel()
 	messages = channels.NewRingChannel(1024)
@@ -638,12 +1289,37 @@ func main() {
 	go collector()
 
 	// start the listeners
-	go readListener(listener4, 4)
-	go readListener(listener6, 6)
+	for _, listener := range listeners {
+		go readListener(listener)
+	}
 
+	// every probe of the peers gets sent by the scheduler
+	var jobs []*job
 	for i := range config.Peers {
-		go pingRoutine(config.Peers[i])
+		if config.Peers[i].IsHostname() {
+			if err = resolve(&config.Peers[i]); err != nil {
+				log.Printf("Unable to resolve %s: %v\n", *config.Peers[i].Address, err)
+			}
+			go resolveRoutine(&config.Peers[i])
+		}
+		switch *config.Peers[i].Type {
+		case PeerTypeMTU:
+			jobs = append(jobs, mtuJob(&config.Peers[i]))
+		case PeerTypeUDP:
+			sends := make(chan struct{}, 1)
+			go udpRoutine(&config.Peers[i], sends)
+			jobs = append(jobs, udpJob(&config.Peers[i], sends))
+		default:
+			jobs = append(jobs, pingJob(&config.Peers[i]))
+		}
+		if *config.Peers[i].MaxHops > 0 {
+			jobs = append(jobs, hopJob(&config.Peers[i]))
+		}
+		if *config.Peers[i].RouteInterval > 0 {
+			jobs = append(jobs, routeJob(&config.Peers[i]))
+		}
 	}
+	go scheduleRoutine(jobs, newPacketBudget(*config.PacketsPerSecond), quitChannel.Add())
 
 	var endWaiter sync.WaitGroup
 	endWaiter.Add(1)
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	// ICMPModeAuto uses raw sockets and falls back to ping sockets if they cannot be opened
+	ICMPModeAuto = "auto"
+	// ICMPModePrivileged uses raw sockets, this needs root or CAP_NET_RAW
+	ICMPModePrivileged = "privileged"
+	// ICMPModeUnprivileged uses datagram ping sockets,
+	// on linux the group must be allowed in net.ipv4.ping_group_range
+	ICMPModeUnprivileged = "unprivileged"
+)
+
+// Listener is an ICMP socket that is used to send echo requests and to receive their replies
+type Listener struct {
+	net.PacketConn
+	IPVersion int
+	// Privileged is true for raw sockets and false for datagram ping sockets
+	Privileged bool
+	// DontFragment is true if the listener sends its messages with the DF bit
+	DontFragment bool
+	// DSCP is the DSCP value the listener marks its messages with
+	DSCP int
+	// Namespace is the network namespace the socket was opened in, empty for the one of icmpmon
+	Namespace string
+}
+
+// ListenICMP opens an ICMP socket for the ip version on address using the
+// socket type mode stands for, if iface is not empty the socket only uses this interface
+func ListenICMP(ipVersion int, mode string, address string, iface string) (*Listener, error) {
+	var rawNetwork, udpNetwork string
+	switch ipVersion {
+	case 4:
+		rawNetwork, udpNetwork = "ip4:icmp", "udp4"
+	case 6:
+		rawNetwork, udpNetwork = "ip6:ipv6-icmp", "udp6"
+	default:
+		return nil, fmt.Errorf("Unknown IpVersion %d", ipVersion)
+	}
+
+	if mode != ICMPModeUnprivileged {
+		conn, err := listenPacket(rawNetwork, address, iface)
+		if err == nil {
+			return &Listener{PacketConn: conn, IPVersion: ipVersion, Privileged: true}, nil
+		}
+		if mode == ICMPModePrivileged {
+			return nil, err
+		}
+		log.Printf("Unable to open raw socket on %s (%v), falling back to ping socket\n", address, err)
+	}
+
+	conn, err := listenPacket(udpNetwork, address, iface)
+	if err != nil {
+		return nil, err
+	}
+	return &Listener{PacketConn: conn, IPVersion: ipVersion, Privileged: false}, nil
+}
+
+// PacketInfo holds what is known about a message besides its content
+type PacketInfo struct {
+	// Received is the time the message was received at
+	Received time.Time
+	// Error is set if the message is an echo request an ICMP error was reported for,
+	// ping sockets get these from the error queue instead of the ICMP error message
+	Error *QueuedError
+	// TTL is the TTL (hop limit for IPv6) the message arrived with, it is 0 if it is unknown
+	TTL int
+}
+
+// QueuedError is an ICMP error the kernel reported for a message sent by a ping socket
+type QueuedError struct {
+	Type int
+	Code int
+	// Info depends on the type, e.g. it is the MTU for packet too big errors
+	Info int
+	// Reporter is the address of the router that sent the error
+	Reporter net.IP
+}
+
+// ReadMessage reads a message from the listener, info.Received is the monotonic time the
+// message was received at
+func (listener *Listener) ReadMessage(b []byte) (n int, addr net.Addr, info PacketInfo, err error) {
+	n, addr, info, err = readMessage(listener.PacketConn, b)
+	kernelTime := info.Received
+	info.Received = time.Now()
+	if !kernelTime.IsZero() {
+		// kernel timestamps use the wall clock, only take the time the message
+		// waited in the socket to keep the monotonic reading of received
+		delay := info.Received.Sub(kernelTime)
+		if delay > 0 && delay < time.Second {
+			info.Received = info.Received.Add(-delay)
+		}
+	}
+	return n, addr, info, err
+}
+
+// enableTTL lets the kernel pass the TTL (hop limit for IPv6) of every received message
+func (listener *Listener) enableTTL() error {
+	if listener.IPVersion == 4 {
+		var conn *ipv4.PacketConn
+		if c, ok := listener.PacketConn.(*icmp.PacketConn); ok {
+			conn = c.IPv4PacketConn()
+		} else {
+			conn = ipv4.NewPacketConn(listener.PacketConn)
+		}
+		return conn.SetControlMessage(ipv4.FlagTTL, true)
+	}
+	var conn *ipv6.PacketConn
+	if c, ok := listener.PacketConn.(*icmp.PacketConn); ok {
+		conn = c.IPv6PacketConn()
+	} else {
+		conn = ipv6.NewPacketConn(listener.PacketConn)
+	}
+	return conn.SetControlMessage(ipv6.FlagHopLimit, true)
+}
+
+// Protocol returns the protocol number needed to parse the messages of the listener
+func (listener *Listener) Protocol() int {
+	if listener.IPVersion == 6 {
+		return ProtocolIPv6ICMP
+	}
+	return ProtocolICMP
+}
+
+// EchoID returns the identifier of the echo replies that belong to this listener.
+// Ping sockets get their identifier rewritten by the kernel to the local port.
+func (listener *Listener) EchoID() int {
+	if !listener.Privileged {
+		if addr, ok := listener.LocalAddr().(*net.UDPAddr); ok {
+			return addr.Port
+		}
+	}
+	return os.Getpid() & 0xffff
+}
+
+// Addr returns the address ip has to be sent to with this listener
+func (listener *Listener) Addr(ip net.IP) net.Addr {
+	if listener.Privileged {
+		return &net.IPAddr{IP: ip}
+	}
+	return &net.UDPAddr{IP: ip}
+}
+
+// WriteToTTL sends b to ip with the TTL (hop limit for IPv6) set to ttl,
+// the default TTL of the system is used if ttl is 0
+func (listener *Listener) WriteToTTL(b []byte, ip net.IP, ttl int) (int, error) {
+	if ttl <= 0 {
+		return listener.WriteTo(b, listener.Addr(ip))
+	}
+	return writeMessage(listener.PacketConn, b, listener.Addr(ip), ttl)
+}
+
+// addrIP returns the ip of an address read from a listener
+func addrIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.IPAddr:
+		return addr.IP
+	case *net.UDPAddr:
+		return addr.IP
+	}
+	return nil
+}
+
+// listeners holds every opened listener by listenerKey
+var listeners = map[string]*Listener{}
+
+func listenerKey(ipVersion int, source string, iface string, dontFragment bool, dscp int, namespace string) string {
+	return fmt.Sprintf("%d|%s|%s|%t|%d|%s", ipVersion, source, iface, dontFragment, dscp, namespace)
+}
+
+// peerSource returns the source address and interface the peer has to be pinged from
+func peerSource(peer *Peer, ipVersion int) (source string, iface string) {
+	if ipVersion == 4 {
+		source = *config.SourceIPv4
+	} else {
+		source = *config.SourceIPv6
+	}
+	iface = *config.Interface
+	if peer.Source != nil && *peer.Source != "" {
+		source = *peer.Source
+	}
+	if peer.Interface != nil && *peer.Interface != "" {
+		iface = *peer.Interface
+	}
+	return source, iface
+}
+
+// openListener opens a listener or returns the already opened one for the same source and interface,
+// the DF bit and the DSCP value are socket options so peers that set them need their own listener.
+// The socket of a listener with a namespace gets opened in this network namespace.
+func openListener(ipVersion int, source string, iface string, dontFragment bool, dscp int, namespace string) (*Listener, error) {
+	key := listenerKey(ipVersion, source, iface, dontFragment, dscp, namespace)
+	if listener, ok := listeners[key]; ok {
+		return listener, nil
+	}
+	var listener *Listener
+	err := inNamespace(namespace, func() (err error) {
+		listener, err = ListenICMP(ipVersion, *config.ICMPMode, source, iface)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	listener.Namespace = namespace
+	if dontFragment {
+		if err = setDontFragment(listener.PacketConn, ipVersion); err != nil {
+			listener.Close()
+			return nil, err
+		}
+		listener.DontFragment = true
+	}
+	if dscp > 0 {
+		if err = setTrafficClass(listener.PacketConn, ipVersion, dscp); err != nil {
+			listener.Close()
+			return nil, err
+		}
+		listener.DSCP = dscp
+	}
+	if config.KernelTimestamps {
+		if err = enableTimestamps(listener.PacketConn); err != nil {
+			log.Printf("Unable to enable kernel timestamps on %s: %v\n", source, err)
+		}
+	}
+	if err = listener.enableTTL(); err != nil {
+		log.Printf("Unable to receive the TTL on %s: %v\n", source, err)
+	}
+	listeners[key] = listener
+	return listener, nil
+}
+
+// openPeerListeners opens the listeners needed for the path of the peer
+func openPeerListeners(peer *Peer) error {
+	if (peer.Path() == "" && !peer.DontFragment && peer.dscp() == 0 && peer.namespace() == *config.Namespace) || !peer.UsesICMP() {
+		return nil
+	}
+	for _, ipVersion := range []int{4, 6} {
+		// with a source address only its ip version can be used
+		if peer.Source != nil && *peer.Source != "" && (net.ParseIP(*peer.Source).To4() != nil) != (ipVersion == 4) {
+			continue
+		}
+		source, iface := peerSource(peer, ipVersion)
+		if _, err := openListener(ipVersion, source, iface, peer.DontFragment, peer.dscp(), peer.namespace()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// peerListener returns the listener to ping ip of the peer with, it is nil if there is none
+func peerListener(peer *Peer, ip net.IP) *Listener {
+	ipVersion := 6
+	if ip.To4() != nil {
+		ipVersion = 4
+	}
+	source, iface := peerSource(peer, ipVersion)
+	return listeners[listenerKey(ipVersion, source, iface, peer.DontFragment, peer.dscp(), peer.namespace())]
+}
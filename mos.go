@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+)
+
+// codecDelay is the delay in Milliseconds the codec of a call adds to the latency
+const codecDelay = 10
+
+// rFactor returns the transmission rating factor of the simplified E-model (ITU-T G.107)
+// for a call with the one way latency and the jitter in Milliseconds and the loss in percent,
+// the jitter buffer adds twice the jitter to the latency
+func rFactor(latency float64, jitter float64, loss float64) float64 {
+	effectiveLatency := latency + 2*jitter + codecDelay
+	r := 93.2 - effectiveLatency/40
+	if effectiveLatency >= 160 {
+		r = 93.2 - (effectiveLatency-120)/10
+	}
+	r -= 2.5 * loss
+	return math.Max(0, math.Min(100, r))
+}
+
+// meanOpinionScore returns the MOS from 1 (bad) to 4.5 (best) of the rating factor r
+func meanOpinionScore(r float64) float64 {
+	if r <= 0 {
+		return 1
+	}
+	if r >= 100 {
+		return 4.5
+	}
+	return 1 + 0.035*r + 0.000007*r*(r-60)*(100-r)
+}
+
+// ratesCalls returns true if the samples of the peer get a MOS,
+// the other types do not measure the path the way a call uses it
+func (peer *Peer) ratesCalls() bool {
+	return *peer.Type == PeerTypeICMP || *peer.Type == PeerTypeUDP
+}
+
+// rate sets the RFactor and the MOS of the query of the peer. A single query is rated with
+// the estimated latency, loss and jitter of the peer, a burst with its own. The response time
+// is the time there and back again, the E-model needs the latency of one way.
+func (h *replyHistory) rate(query *Query) {
+	if !h.responded {
+		// the peer never responded
+		query.MOS = meanOpinionScore(0)
+		return
+	}
+	latency := query.ResponseTime
+	loss := query.Loss
+	jitter := query.Jitter
+	if query.Sent > 0 && latency < 0 {
+		latency = h.responseTime
+	} else if query.Sent == 0 {
+		latency = h.responseTime
+		loss = 0
+		if query.ResponseTime < 0 {
+			loss = 100
+		}
+		if h.rated {
+			latency = h.latency + (latency-h.latency)/16
+			loss = h.loss + (loss-h.loss)/16
+		}
+		h.latency = latency
+		h.loss = loss
+		h.rated = true
+		jitter = query.InterarrivalJitter
+	}
+	query.RFactor = rFactor(latency/2, jitter, loss)
+	query.MOS = meanOpinionScore(query.RFactor)
+}
+
+// recordQuery records the query in the reply history of its peer, an event gets recorded
+// if its MOS fell below MinMOS of the peer or recovered to a tenth above it
+func recordQuery(query *Query) {
+	h := history(query.PeerID)
+	h.record(query)
+	peer := peerByID(query.PeerID)
+	if peer == nil || !peer.ratesCalls() {
+		return
+	}
+	h.rate(query)
+	if peer.MinMOS != nil && (!h.belowMOS && query.MOS < *peer.MinMOS || h.belowMOS && query.MOS >= *peer.MinMOS+0.1) {
+		h.belowMOS = !h.belowMOS
+		event := Event{
+			PeerID: query.PeerID,
+			Time:   query.Time,
+			Type:   EventMOSChanged,
+			New:    fmt.Sprintf("%.2f", query.MOS),
+		}
+		if h.mos > 0 {
+			event.Old = fmt.Sprintf("%.2f", h.mos)
+		}
+		if h.belowMOS {
+			log.Printf("MOS of %s fell below %.2f to %s\n", *peer.Name, *peer.MinMOS, event.New)
+		} else {
+			log.Printf("MOS of %s recovered to %s\n", *peer.Name, event.New)
+		}
+		db.Create(&event)
+	}
+	h.mos = query.MOS
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/bits"
+	"net"
+	"time"
+)
+
+const (
+	// MinMTUIPv4 is the smallest MTU every IPv4 link has
+	MinMTUIPv4 = 68
+	// MinMTUIPv6 is the smallest MTU every IPv6 link has
+	MinMTUIPv6 = 1280
+)
+
+// errQuit is returned by discoverMTU if icmpmon is quitting
+var errQuit = errors.New("quitting")
+
+// probeMTU sends an echo request that is mtu bytes big with the DF bit set and reports if it got through,
+// reported is the MTU a router reported if it was too big
+func probeMTU(peer *Peer, ip net.IP, listener *Listener, mtu int, budget *packetBudget, quit <-chan struct{}) (fits bool, reported int, err error) {
+	headerLength := 20 + 8
+	if ip.To4() == nil {
+		headerLength = 40 + 8
+	}
+	// a lost probe is retried once, so only black holes look like a too big packet
+	for try := 0; try < 2; try++ {
+		if !budget.wait(1, quit) {
+			return false, 0, errQuit
+		}
+		result := make(chan Query, 1)
+		if err = sendEcho(peer, ip, listener, mtu-headerLength, 0, result); err != nil {
+			return false, 0, err
+		}
+		var query Query
+		select {
+		case query = <-result:
+		case <-time.After(time.Duration(*peer.Timeout)*time.Millisecond + 2*time.Second):
+			query.Outcome = OutcomeTimeout
+		case <-quit:
+			return false, 0, errQuit
+		}
+		switch query.Outcome {
+		case OutcomeOK, OutcomeCorrupted:
+			return true, 0, nil
+		case OutcomePacketTooBig:
+			return false, query.MTU, nil
+		case OutcomeTimeout:
+			continue
+		default:
+			return false, 0, nil
+		}
+	}
+	return false, 0, nil
+}
+
+// discoverMTU binary searches the largest echo request that gets through to the peer with the DF bit set,
+// it returns 0 if the hostname of the peer was not resolved yet
+func discoverMTU(peer *Peer, budget *packetBudget, quit <-chan struct{}) (int, error) {
+	ip := peer.IP()
+	if ip == nil {
+		// hostname was not resolved yet
+		return 0, nil
+	}
+	listener := peerListener(peer, ip)
+	if listener == nil {
+		return 0, fmt.Errorf("Unable to ping %s via %s", ip, peer.Path())
+	}
+
+	low := MinMTUIPv4
+	if ip.To4() == nil {
+		low = MinMTUIPv6
+	}
+	high := *peer.MaxMTU
+	if high <= low {
+		high = low
+	}
+
+	fits, reported, err := probeMTU(peer, ip, listener, high, budget, quit)
+	if err != nil || fits {
+		return high, err
+	}
+	if fits, _, err = probeMTU(peer, ip, listener, low, budget, quit); err != nil {
+		return 0, err
+	}
+	if !fits {
+		return 0, fmt.Errorf("%s does not reply to echo requests of %d bytes", ip, low)
+	}
+
+	// low always fits, high never does
+	for high-low > 1 {
+		mtu := (low + high) / 2
+		// try the MTU a router reported first, it is most likely the right one
+		if reported > low && reported < high {
+			mtu = reported
+		}
+		fits, reported, err = probeMTU(peer, ip, listener, mtu, budget, quit)
+		if err != nil {
+			return 0, err
+		}
+		if fits {
+			low = mtu
+		} else {
+			high = mtu
+		}
+	}
+	return low, nil
+}
+
+// mtuJob returns the job that discovers the path MTU of a peer every Interval and
+// records an Event if it got smaller than the last time
+func mtuJob(peer *Peer) *job {
+	var last PathMTU
+	db.Where("peer_id = ?", *peer.ID).Order("time desc").Limit(1).Find(&last)
+	return &job{
+		interval: time.Duration(*peer.Interval) * time.Millisecond,
+		// the probes of the binary search and the retries of lost ones
+		packets: 2 * (2 + bits.Len(uint(*peer.MaxMTU))),
+		async:   true,
+		run: func(budget *packetBudget, quit <-chan struct{}) {
+			last = updateMTU(peer, last, budget, quit)
+		},
+	}
+}
+
+// updateMTU discovers the path MTU of the peer and records an Event if it is smaller than last,
+// it returns the path MTU to compare the next one with
+func updateMTU(peer *Peer, last PathMTU, budget *packetBudget, quit <-chan struct{}) PathMTU {
+	mtu, err := discoverMTU(peer, budget, quit)
+	if err == errQuit {
+		return last
+	}
+	if err != nil {
+		log.Printf("Unable to discover the path MTU of %s: %v\n", *peer.Name, err)
+		return last
+	}
+	if mtu == 0 {
+		return last
+	}
+	pathMTU := PathMTU{
+		PeerID: *peer.ID,
+		Time:   time.Now().UTC().UnixNano() / 1000000,
+		MTU:    mtu,
+	}
+	if last.MTU > 0 && mtu < last.MTU {
+		log.Printf("Path MTU of %s shrunk from %d to %d\n", *peer.Name, last.MTU, mtu)
+		messages.In() <- Event{
+			PeerID: *peer.ID,
+			Time:   pathMTU.Time,
+			Type:   EventMTUShrunk,
+			Old:    fmt.Sprint(last.MTU),
+			New:    fmt.Sprint(mtu),
+		}
+	}
+	messages.In() <- pathMTU
+	return pathMTU
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
+
+	"golang.org/x/sys/unix"
+)
+
+// namespacePath returns the path of the network namespace name,
+// names without a slash are the ones "ip netns" created
+func namespacePath(name string) string {
+	if filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join("/var/run/netns", name)
+}
+
+// namespaceNameServers returns the name servers "ip netns exec" uses in the network namespace name,
+// the ones in /etc/netns/NAME/resolv.conf, it is empty if there is none
+func namespaceNameServers(name string) []string {
+	if filepath.IsAbs(name) {
+		return nil
+	}
+	file, err := os.Open(filepath.Join("/etc/netns", name, "resolv.conf"))
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+	var servers []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" && net.ParseIP(fields[1]) != nil {
+			servers = append(servers, fields[1])
+		}
+	}
+	return servers
+}
+
+// namespaceResolver returns the resolver for the hostnames of peers in the network namespace name.
+// The lookups run on other goroutines, so the resolver dials the name servers from the namespace itself:
+// the ones of namespaceNameServers, the ones of the host if there are none.
+func namespaceResolver(name string) *net.Resolver {
+	servers := namespaceNameServers(name)
+	var next uint32
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network string, address string) (conn net.Conn, err error) {
+			if len(servers) > 0 {
+				// the resolver tries the next server if one fails
+				address = net.JoinHostPort(servers[(atomic.AddUint32(&next, 1)-1)%uint32(len(servers))], "53")
+			}
+			var dialer net.Dialer
+			err = inNamespace(name, func() (err error) {
+				conn, err = dialer.DialContext(ctx, network, address)
+				return err
+			})
+			return conn, err
+		},
+	}
+}
+
+// inNamespace calls f on a thread that joined the network namespace name, the sockets
+// f creates stay in the namespace. If name is empty f gets called right away.
+func inNamespace(name string, f func() error) error {
+	if name == "" {
+		return f()
+	}
+	namespace, err := os.Open(namespacePath(name))
+	if err != nil {
+		return fmt.Errorf("unable to open the network namespace %s: %v", name, err)
+	}
+	defer namespace.Close()
+
+	// the goroutine has its own thread, if it cannot leave the namespace
+	// it exits with the thread still locked and the thread gets terminated
+	errs := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		current, err := os.Open(fmt.Sprintf("/proc/self/task/%d/ns/net", unix.Gettid()))
+		if err != nil {
+			runtime.UnlockOSThread()
+			errs <- err
+			return
+		}
+		defer current.Close()
+		if err = unix.Setns(int(namespace.Fd()), unix.CLONE_NEWNET); err != nil {
+			runtime.UnlockOSThread()
+			errs <- fmt.Errorf("unable to join the network namespace %s: %v", name, err)
+			return
+		}
+		err = f()
+		if nerr := unix.Setns(int(current.Fd()), unix.CLONE_NEWNET); nerr != nil {
+			errs <- fmt.Errorf("unable to leave the network namespace %s: %v", name, nerr)
+			return
+		}
+		runtime.UnlockOSThread()
+		errs <- err
+	}()
+	return <-errs
+}
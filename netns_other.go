@@ -0,0 +1,22 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// inNamespace calls f, network namespaces are only supported on linux
+func inNamespace(name string, f func() error) error {
+	if name != "" {
+		return errors.New("network namespaces are only supported on linux")
+	}
+	return f()
+}
+
+// namespaceResolver returns the default resolver, network namespaces are only supported on linux
+func namespaceResolver(name string) *net.Resolver {
+	return net.DefaultResolver
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"time"
+)
+
+// EchoPayloadLength is the length of the data every echo request carries:
+// the token of this process, the id of the peer, the time the request was sent and a random nonce
+const EchoPayloadLength = 32
+
+// MaxEchoPayloadLength is the most data an echo request fits in an IPv4 packet
+const MaxEchoPayloadLength = 65535 - 20 - 8
+
+// processToken identifies the echo requests sent by this process
+var processToken = randomUint64()
+
+func randomUint64() uint64 {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		// fall back to something that is at least unique per start
+		return uint64(time.Now().UnixNano())
+	}
+	return binary.BigEndian.Uint64(b[:])
+}
+
+// newEchoPayload creates the data for an echo request to peer that is sent at sent,
+// it is filled up to size with the pattern of the peer
+func newEchoPayload(peer *Peer, size int, sent time.Time) []byte {
+	if size < EchoPayloadLength {
+		size = EchoPayloadLength
+	}
+	data := make([]byte, size)
+	binary.BigEndian.PutUint64(data[0:], processToken)
+	binary.BigEndian.PutUint64(data[8:], uint64(*peer.ID))
+	binary.BigEndian.PutUint64(data[16:], uint64(sent.UnixNano()))
+	binary.BigEndian.PutUint64(data[24:], randomUint64())
+	for i := EchoPayloadLength; i < size; i++ {
+		if len(peer.pattern) > 0 {
+			data[i] = peer.pattern[(i-EchoPayloadLength)%len(peer.pattern)]
+		} else {
+			data[i] = byte(i)
+		}
+	}
+	return data
+}
+
+// echoPayloadPeer returns the id of the peer an echo reply belongs to,
+// ok is false if the payload was not sent by this process
+func echoPayloadPeer(data []byte) (peerID int64, ok bool) {
+	if len(data) < EchoPayloadLength || binary.BigEndian.Uint64(data) != processToken {
+		return 0, false
+	}
+	return int64(binary.BigEndian.Uint64(data[8:])), true
+}
+
+// validateReply returns why response is not the reply to request, it is empty if the response is valid
+func validateReply(request *Request, response *Response) string {
+	if !request.IP.Equal(response.IP) {
+		return "source"
+	}
+	// routers might only quote the first 8 bytes of the request in errors
+	if response.Outcome != OutcomeOK && len(response.Payload) < EchoPayloadLength {
+		return ""
+	}
+	if _, ok := echoPayloadPeer(response.Payload); !ok {
+		return "token"
+	}
+	if !bytes.Equal(request.Payload[:EchoPayloadLength], response.Payload[:EchoPayloadLength]) {
+		return "payload"
+	}
+	return ""
+}
+
+// payloadIntact returns false if the data after the first EchoPayloadLength bytes
+// of a valid echo reply differs from the data that was sent
+func payloadIntact(request *Request, response *Response) bool {
+	if len(response.Payload) < EchoPayloadLength {
+		return false
+	}
+	return bytes.Equal(request.Payload[EchoPayloadLength:], response.Payload[EchoPayloadLength:])
+}
@@ -21,12 +21,16 @@ func (quitChannel *QuitChannel) Add() chan bool {
 }
 
 func (quitChannel *QuitChannel) SignalQuit() {
+	quitChannel.RLock()
+	defer quitChannel.RUnlock()
 	for i := range quitChannel.channels {
 		quitChannel.channels[i] <- true
 	}
 }
 
 func (quitChannel *QuitChannel) WaitForCleanup() {
+	quitChannel.RLock()
+	defer quitChannel.RUnlock()
 	for i := range quitChannel.channels {
 		<-quitChannel.channels[i]
 	}
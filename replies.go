@@ -0,0 +1,114 @@
+package main
+
+import (
+	"time"
+)
+
+// replyHistory is what the collector remembers about the replies of a peer
+type replyHistory struct {
+	// highestSeq is the highest sequence number a reply to a regular echo request arrived for, 0 if none did
+	highestSeq int
+	// answered are the echo requests that got a reply until their timeout,
+	// another reply to them is a duplicate
+	answered map[RequestKey]Request
+	// duplicates is the number of duplicate replies since the last query
+	duplicates int
+	// responseTime is the ResponseTime of the last query that got a response, responded is false until one did
+	responseTime float64
+	responded    bool
+	// jitter is the interarrival jitter estimate (RFC 3550) in Milliseconds
+	jitter float64
+	// latency and loss are the response time and the percentage of lost queries,
+	// they get estimated with the same gain as the jitter
+	latency float64
+	loss    float64
+	rated   bool
+	// mos is the MOS of the last query, belowMOS is true if it was below MinMOS of the peer
+	mos      float64
+	belowMOS bool
+}
+
+// replyHistories holds the reply history by peer id, it is only used by the collector
+var replyHistories = map[int64]*replyHistory{}
+
+// history returns the reply history of the peer
+func history(peerID int64) *replyHistory {
+	h, ok := replyHistories[peerID]
+	if !ok {
+		h = &replyHistory{answered: map[RequestKey]Request{}}
+		replyHistories[peerID] = h
+	}
+	return h
+}
+
+// seqBefore returns true if the sequence number a was sent before b,
+// nextSeq counts from 1 to 65535 and then starts over
+func seqBefore(a int, b int) bool {
+	d := (b - a + 65535) % 65535
+	return d > 0 && d < 65535/2
+}
+
+// answer remembers that the echo request got a reply,
+// it returns true if the reply arrived after the reply to a later request
+func (h *replyHistory) answer(request *Request) bool {
+	h.answered[request.Key()] = *request
+	// hop, path MTU and burst probes share the sequence numbers of the peer,
+	// only the replies to its regular echo requests tell if the path reorders them
+	if request.Result != nil {
+		return false
+	}
+	if h.highestSeq != 0 && seqBefore(request.Seq, h.highestSeq) {
+		return true
+	}
+	h.highestSeq = request.Seq
+	return false
+}
+
+// duplicateReply returns the answered echo request the response is another reply to
+func duplicateReply(response *Response) (Request, bool) {
+	peerID, ok := echoPayloadPeer(response.Payload)
+	if !ok || response.Outcome != OutcomeOK {
+		return Request{}, false
+	}
+	h, ok := replyHistories[peerID]
+	if !ok {
+		return Request{}, false
+	}
+	request, ok := h.answered[RequestKey{PeerID: peerID, EchoID: response.EchoID, Seq: response.Seq}]
+	// a raw socket without interface also receives the replies
+	// that were sent through other listeners
+	if !ok || request.Listener != response.Listener {
+		return Request{}, false
+	}
+	h.duplicates++
+	return request, true
+}
+
+// expire forgets the answered requests that timed out
+func (h *replyHistory) expire(now time.Time) {
+	for key, request := range h.answered {
+		if now.Sub(request.Sent) >= time.Duration(*request.Peer.Timeout)*time.Millisecond {
+			delete(h.answered, key)
+		}
+	}
+}
+
+// record sets the Duplicates since the last query and the InterarrivalJitter of the query.
+// The jitter is estimated like RFC 3550 does with the transit times of RTP packets:
+// the difference of successive response times goes into it with a gain of 1/16.
+func (h *replyHistory) record(query *Query) {
+	query.Duplicates = h.duplicates
+	h.duplicates = 0
+	if query.ResponseTime >= 0 {
+		if h.responded {
+			d := query.ResponseTime - h.responseTime
+			if d < 0 {
+				d = -d
+			}
+			h.jitter += (d - h.jitter) / 16
+		}
+		h.responseTime = query.ResponseTime
+		h.responded = true
+	}
+	query.InterarrivalJitter = h.jitter
+}
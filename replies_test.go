@@ -0,0 +1,33 @@
+package main
+
+import "testing"
+
+func TestAnswerReordered(t *testing.T) {
+	id := int64(1)
+	peer := Peer{ID: &id}
+	probe := make(chan Query, 1)
+	h := &replyHistory{answered: map[RequestKey]Request{}}
+	tests := []struct {
+		name      string
+		seq       int
+		result    chan<- Query
+		reordered bool
+	}{
+		{"first", 1, nil, false},
+		{"next", 2, nil, false},
+		// e.g. the echo request of a hop or an MTU probe
+		{"probe", 4, probe, false},
+		{"after the probe", 3, nil, false},
+		{"late probe", 1, probe, false},
+		{"overtaking", 6, nil, false},
+		{"overtaken", 5, nil, true},
+	}
+	for _, test := range tests {
+		if got := h.answer(&Request{Peer: &peer, Seq: test.seq, Result: test.result}); got != test.reordered {
+			t.Errorf("%s: got reordered %v for %d, want %v", test.name, got, test.seq, test.reordered)
+		}
+	}
+	if _, ok := h.answered[RequestKey{PeerID: id, Seq: 4}]; !ok {
+		t.Error("the reply to the probe is not remembered for duplicates")
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
+
+// Resolver looks up the addresses of a hostname.
+// *net.Resolver satisfies it, other implementations can be used to answer
+// lookups without a real name server.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// ResolveTimeout is the time a lookup of a hostname may take,
+// name servers can be much slower to answer than the peer
+const ResolveTimeout = 5 * time.Second
+
+// newResolver returns the resolver for lookups from the network namespace, "" is the one of icmpmon.
+// A peer in a network namespace needs one that sends its queries from there.
+var newResolver = func(namespace string) Resolver {
+	if namespace != "" {
+		return namespaceResolver(namespace)
+	}
+	return net.DefaultResolver
+}
+
+// peerResolver returns the resolver for the hostname of the peer
+func peerResolver(peer *Peer) Resolver {
+	return newResolver(peer.namespace())
+}
+
+// resolve looks up the address of the peer and updates its ip if it changed.
+// An Event gets recorded for every change of an already known ip.
+func resolve(peer *Peer) error {
+	ctx, cancel := context.WithTimeout(context.Background(), ResolveTimeout)
+	defer cancel()
+	addrs, err := peerResolver(peer).LookupIPAddr(ctx, *peer.Address)
+	if err != nil {
+		return err
+	}
+	if len(addrs) == 0 {
+		return fmt.Errorf("'%s' has no addresses", *peer.Address)
+	}
+
+	current := peer.IP()
+	// keep the current ip as long as the name still points to it,
+	// this avoids jumping between the addresses of round robin records
+	for _, addr := range addrs {
+		if addr.IP.Equal(current) {
+			return nil
+		}
+	}
+
+	ip := addrs[0].IP
+	peer.setIP(ip)
+	if current == nil {
+		log.Printf("Resolved %s to %s\n", *peer.Address, ip)
+		return nil
+	}
+	log.Printf("Address of %s changed from %s to %s\n", *peer.Address, current, ip)
+	messages.In() <- Event{
+		PeerID: *peer.ID,
+		Time:   time.Now().UTC().UnixNano() / 1000000,
+		Type:   EventAddressChanged,
+		Old:    current.String(),
+		New:    ip.String(),
+	}
+	return nil
+}
+
+// resolveRoutine re-resolves the hostname of a peer every ResolveInterval
+func resolveRoutine(peer *Peer) {
+	interval := time.Duration(*peer.ResolveInterval) * time.Millisecond
+	// Subscribe to quitChannel
+	quitChannel := quitChannel.Add()
+	ticker := time.NewTicker(interval)
+	for {
+		select {
+		case <-quitChannel:
+			quitChannel <- true
+			return
+		case <-ticker.C:
+			if err := resolve(peer); err != nil {
+				log.Printf("Unable to resolve %s: %v\n", *peer.Address, err)
+			}
+		}
+	}
+}
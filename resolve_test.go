@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"gopkg.in/eapache/channels.v1"
+)
+
+// stubResolver answers lookups with the addresses in hosts
+type stubResolver struct {
+	hosts map[string][]string
+	// namespace is the network namespace of the last lookup, timeout the time it was allowed to take
+	namespace string
+	timeout   time.Duration
+}
+
+func (r *stubResolver) resolver(namespace string) Resolver {
+	r.namespace = namespace
+	return r
+}
+
+func (r *stubResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		r.timeout = time.Until(deadline)
+	}
+	addresses, ok := r.hosts[host]
+	if !ok {
+		return nil, errors.New("no such host")
+	}
+	var addrs []net.IPAddr
+	for _, address := range addresses {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(address)})
+	}
+	return addrs, nil
+}
+
+func TestResolve(t *testing.T) {
+	peers := useTestConfig(t, "{\nPeers: [\n{\nAddress: host.test\nTimeout: 10\n}\n{\nAddress: red.test\nNamespace: red\n}\n]\n}")
+	messages = channels.NewRingChannel(16)
+	stub := &stubResolver{hosts: map[string][]string{"host.test": {"192.0.2.1"}, "red.test": {"2001:db8::1"}}}
+	defer func(r func(string) Resolver) { newResolver = r }(newResolver)
+	newResolver = stub.resolver
+
+	expect := func(step string, peer *Peer, ip string) {
+		t.Helper()
+		if !peer.IP().Equal(net.ParseIP(ip)) {
+			t.Fatalf("%s: resolved %s to %s, want %s", step, *peer.Address, peer.IP(), ip)
+		}
+		if messages.Len() != 0 {
+			t.Fatalf("%s: recorded %v", step, <-messages.Out())
+		}
+	}
+
+	// at startup
+	if err := resolve(&peers[0]); err != nil {
+		t.Fatal(err)
+	}
+	expect("startup", &peers[0], "192.0.2.1")
+	if stub.namespace != "" || stub.timeout < ResolveTimeout-time.Second {
+		t.Fatalf("looked up %s in the namespace '%s' with a timeout of %s", *peers[0].Address, stub.namespace, stub.timeout)
+	}
+
+	// round robin records keep the current address
+	stub.hosts["host.test"] = []string{"192.0.2.2", "192.0.2.1"}
+	if err := resolve(&peers[0]); err != nil {
+		t.Fatal(err)
+	}
+	expect("round robin", &peers[0], "192.0.2.1")
+
+	// a failed lookup keeps the current address as well
+	delete(stub.hosts, "host.test")
+	if err := resolve(&peers[0]); err == nil {
+		t.Fatal("got no error for a failed lookup")
+	}
+	expect("failed", &peers[0], "192.0.2.1")
+
+	stub.hosts["host.test"] = []string{"192.0.2.3"}
+	if err := resolve(&peers[0]); err != nil {
+		t.Fatal(err)
+	}
+	if !peers[0].IP().Equal(net.ParseIP("192.0.2.3")) {
+		t.Fatalf("resolved the changed address to %s", peers[0].IP())
+	}
+	select {
+	case message := <-messages.Out():
+		event, ok := message.(Event)
+		if !ok || event.Type != EventAddressChanged || event.PeerID != *peers[0].ID || event.Old != "192.0.2.1" || event.New != "192.0.2.3" {
+			t.Fatalf("recorded %+v for the changed address", message)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("recorded no event for the changed address")
+	}
+
+	if err := resolve(&peers[1]); err != nil {
+		t.Fatal(err)
+	}
+	expect("namespace", &peers[1], "2001:db8::1")
+	if stub.namespace != "red" {
+		t.Fatalf("looked up %s in the namespace '%s'", *peers[1].Address, stub.namespace)
+	}
+}
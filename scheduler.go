@@ -0,0 +1,202 @@
+package main
+
+import (
+	"container/heap"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// job is a probe of a peer the scheduler runs every interval
+type job struct {
+	interval time.Duration
+	// packets is the most packets a run of the job sends
+	packets int
+	// async jobs wait for their replies, they run in a goroutine of their own and charge
+	// their packets to the budget when they send them, a run gets skipped while the last one still runs.
+	// The scheduler charges the packets of the other jobs before it runs them.
+	async bool
+	// run gets the budget async jobs charge their packets to and quit, which gets closed when icmpmon quits
+	run func(budget *packetBudget, quit <-chan struct{})
+	// next is the time the job runs at next
+	next    time.Time
+	running int32
+}
+
+// pingJob returns the job that probes the peer with the probe of its type
+func pingJob(peer *Peer) *job {
+	packets := 1
+	if *peer.Type == PeerTypeICMP {
+		packets = *peer.Count
+		if peer.Timestamps {
+			packets++
+		}
+	}
+	return &job{
+		interval: time.Duration(*peer.Interval) * time.Millisecond,
+		packets:  packets,
+		run: func(*packetBudget, <-chan struct{}) {
+			if err := probe(peer); err != nil {
+				// e.g. the uplink of the path is down
+				log.Printf("Unable to ping %s: %v\n", *peer.Name, err)
+			}
+		},
+	}
+}
+
+// packetBudget paces the packets of all jobs to packetsPerSecond
+type packetBudget struct {
+	sync.Mutex
+	// packetsPerSecond is 0 for no limit
+	packetsPerSecond int
+	// until is the time the packets reserved so far used up the budget until
+	until time.Time
+}
+
+func newPacketBudget(packetsPerSecond int) *packetBudget {
+	return &packetBudget{packetsPerSecond: packetsPerSecond}
+}
+
+// reserve reserves the packets and returns the time they can be sent at
+func (b *packetBudget) reserve(packets int) time.Time {
+	now := time.Now()
+	if b.packetsPerSecond <= 0 {
+		return now
+	}
+	b.Lock()
+	defer b.Unlock()
+	at := b.until
+	if at.Before(now) {
+		at = now
+	}
+	b.until = at.Add(time.Duration(packets) * time.Second / time.Duration(b.packetsPerSecond))
+	return at
+}
+
+// wait reserves the packets and waits until they can be sent, it returns false if quit got closed first
+func (b *packetBudget) wait(packets int, quit <-chan struct{}) bool {
+	d := time.Until(b.reserve(packets))
+	if d <= 0 {
+		return true
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-quit:
+		return false
+	}
+}
+
+// jobQueue is a min heap of the jobs by the time they run at next
+type jobQueue []*job
+
+func (queue jobQueue) Len() int           { return len(queue) }
+func (queue jobQueue) Less(i, j int) bool { return queue[i].next.Before(queue[j].next) }
+func (queue jobQueue) Swap(i, j int)      { queue[i], queue[j] = queue[j], queue[i] }
+
+func (queue *jobQueue) Push(x interface{}) {
+	*queue = append(*queue, x.(*job))
+}
+
+func (queue *jobQueue) Pop() interface{} {
+	old := *queue
+	j := old[len(old)-1]
+	*queue = old[:len(old)-1]
+	return j
+}
+
+// spreadJobs returns the queue of the jobs, the jobs with the same interval
+// run one after another spread evenly across it instead of all at once
+func spreadJobs(jobs []*job, start time.Time) jobQueue {
+	total := map[time.Duration]int{}
+	for _, j := range jobs {
+		total[j.interval]++
+	}
+	scheduled := map[time.Duration]int{}
+	queue := make(jobQueue, 0, len(jobs))
+	for _, j := range jobs {
+		j.next = start.Add(j.interval * time.Duration(scheduled[j.interval]) / time.Duration(total[j.interval]))
+		scheduled[j.interval]++
+		queue = append(queue, j)
+	}
+	heap.Init(&queue)
+	return queue
+}
+
+// scheduleRoutine runs the jobs every interval from one goroutine until it gets signaled on quitChannel,
+// it answers on quitChannel once the jobs stopped. The packets of all jobs get evenly paced
+// to stay within the budget, a job that fell behind a whole interval skips the missed runs.
+func scheduleRoutine(jobs []*job, budget *packetBudget, quitChannel chan bool) {
+	quit := make(chan struct{})
+	var running sync.WaitGroup
+	stop := func() {
+		// the async jobs stop sending, they are done once they returned
+		close(quit)
+		running.Wait()
+		quitChannel <- true
+	}
+
+	if packetsPerSecond := budget.packetsPerSecond; packetsPerSecond > 0 {
+		var needed float64
+		for _, j := range jobs {
+			needed += float64(j.packets) / j.interval.Seconds()
+		}
+		if needed > float64(packetsPerSecond) {
+			log.Printf("The peers need up to %.0f packets per second, PacketsPerSecond limits them to %d\n", needed, packetsPerSecond)
+		}
+	}
+
+	queue := spreadJobs(jobs, time.Now())
+	timer := time.NewTimer(time.Hour)
+	for {
+		if len(queue) == 0 {
+			<-quitChannel
+			stop()
+			return
+		}
+		j := queue[0]
+		timer.Reset(time.Until(j.next))
+		select {
+		case <-quitChannel:
+			timer.Stop()
+			stop()
+			return
+		case <-timer.C:
+		}
+
+		switch {
+		case j.async && atomic.LoadInt32(&j.running) != 0:
+			// e.g. the replies of the last route snapshot are still outstanding
+		case j.async:
+			atomic.StoreInt32(&j.running, 1)
+			running.Add(1)
+			go func(j *job) {
+				defer running.Done()
+				j.run(budget, quit)
+				atomic.StoreInt32(&j.running, 0)
+			}(j)
+		default:
+			if d := time.Until(budget.reserve(j.packets)); d > 0 {
+				timer.Reset(d)
+				select {
+				case <-quitChannel:
+					timer.Stop()
+					stop()
+					return
+				case <-timer.C:
+				}
+			}
+			j.run(budget, quit)
+		}
+
+		j.next = j.next.Add(j.interval)
+		if behind := time.Since(j.next); behind >= 0 {
+			// keep the phase of the job
+			j.next = j.next.Add((behind/j.interval + 1) * j.interval)
+		}
+		heap.Fix(&queue, 0)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSpreadJobs(t *testing.T) {
+	var jobs []*job
+	for i := 0; i < 4; i++ {
+		jobs = append(jobs, &job{interval: time.Second})
+	}
+	jobs = append(jobs, &job{interval: 2 * time.Second})
+	start := time.Now()
+	queue := spreadJobs(jobs, start)
+	for i, want := range []time.Duration{0, 250 * time.Millisecond, 500 * time.Millisecond, 750 * time.Millisecond, 0} {
+		if got := jobs[i].next.Sub(start); got != want {
+			t.Errorf("job %d starts after %s, want %s", i, got, want)
+		}
+	}
+	if !queue[0].next.Equal(start) {
+		t.Errorf("the first job starts after %s", queue[0].next.Sub(start))
+	}
+}
+
+func TestPacketBudget(t *testing.T) {
+	budget := newPacketBudget(100)
+	start := time.Now()
+	for i, want := range []time.Duration{0, 10 * time.Millisecond, 20 * time.Millisecond, 70 * time.Millisecond} {
+		packets := 1
+		if i == 2 {
+			packets = 5
+		}
+		// the test takes a moment itself
+		if got := budget.reserve(packets).Sub(start); got < want || got > want+5*time.Millisecond {
+			t.Errorf("packet %d can be sent after %s, want %s", i, got, want)
+		}
+	}
+
+	if got := time.Until(newPacketBudget(0).reserve(1000)); got > 0 {
+		t.Errorf("got a delay of %s without a budget", got)
+	}
+}
+
+func TestScheduleRoutine(t *testing.T) {
+	// 40 probes every 100ms need 400 packets per second, twice the budget
+	var sent int32
+	var jobs []*job
+	for i := 0; i < 40; i++ {
+		jobs = append(jobs, &job{
+			interval: 100 * time.Millisecond,
+			packets:  1,
+			run:      func(*packetBudget, <-chan struct{}) { atomic.AddInt32(&sent, 1) },
+		})
+	}
+	// sends 10 packets every 500ms on its own
+	var asyncSent, asyncRuns int32
+	jobs = append(jobs, &job{
+		interval: 500 * time.Millisecond,
+		packets:  10,
+		async:    true,
+		run: func(budget *packetBudget, quit <-chan struct{}) {
+			atomic.AddInt32(&asyncRuns, 1)
+			for i := 0; i < 10 && budget.wait(1, quit); i++ {
+				atomic.AddInt32(&asyncSent, 1)
+			}
+		},
+	})
+	quit := make(chan bool)
+	go scheduleRoutine(jobs, newPacketBudget(200), quit)
+	time.Sleep(time.Second)
+	quit <- true
+	// the routine answers once the jobs stopped
+	<-quit
+
+	total := atomic.LoadInt32(&sent) + atomic.LoadInt32(&asyncSent)
+	if total < 150 || total > 210 {
+		t.Errorf("sent %d packets in a second with a budget of 200", total)
+	}
+	if atomic.LoadInt32(&asyncSent) == 0 || atomic.LoadInt32(&asyncRuns) > 3 {
+		t.Errorf("the async job ran %d times and sent %d packets", asyncRuns, asyncSent)
+	}
+}
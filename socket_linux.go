@@ -0,0 +1,365 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// listenPacket opens a raw (ip4:icmp, ip6:ipv6-icmp) or ping (udp4, udp6) socket on address,
+// if iface is not empty the socket gets bound to this interface (SO_BINDTODEVICE)
+func listenPacket(network, address, iface string) (net.PacketConn, error) {
+	var family, proto int
+	switch network {
+	case "udp4":
+		family, proto = syscall.AF_INET, ProtocolICMP
+	case "udp6":
+		family, proto = syscall.AF_INET6, ProtocolIPv6ICMP
+	default:
+		listenConfig := net.ListenConfig{
+			Control: func(network, address string, c syscall.RawConn) error {
+				return bindToDevice(c, iface)
+			},
+		}
+		return listenConfig.ListenPacket(context.Background(), network, address)
+	}
+
+	// the net package has no support for ping sockets, so create it by hand
+	fd, err := syscall.Socket(family, syscall.SOCK_DGRAM, proto)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	if iface != "" {
+		if err = syscall.SetsockoptString(fd, syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, iface); err != nil {
+			syscall.Close(fd)
+			return nil, os.NewSyscallError("setsockopt", err)
+		}
+	}
+	// ping sockets only get ICMP errors through the error queue
+	if family == syscall.AF_INET {
+		err = syscall.SetsockoptInt(fd, syscall.SOL_IP, syscall.IP_RECVERR, 1)
+	} else {
+		err = syscall.SetsockoptInt(fd, syscall.SOL_IPV6, syscall.IPV6_RECVERR, 1)
+	}
+	if err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("setsockopt", err)
+	}
+	sa, err := sockaddr(family, address)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	if err = syscall.Bind(fd, sa); err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("bind", err)
+	}
+	file := os.NewFile(uintptr(fd), fmt.Sprintf("%s:%s", network, address))
+	defer file.Close()
+	return net.FilePacketConn(file)
+}
+
+// enableTimestamps lets the kernel add the time a message was received to every message (SO_TIMESTAMPNS)
+func enableTimestamps(conn net.PacketConn) error {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return fmt.Errorf("%T does not support timestamps", conn)
+	}
+	c, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	cerr := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_TIMESTAMPNS, 1)
+	})
+	if cerr != nil {
+		return cerr
+	}
+	if err != nil {
+		return os.NewSyscallError("setsockopt", err)
+	}
+	return nil
+}
+
+// setDontFragment sets the DF bit on every message sent by conn. Unlike IP_PMTUDISC_DO,
+// IP_PMTUDISC_PROBE ignores the path MTU the kernel learned, so too big messages still
+// get sent and the router that drops them keeps reporting the MTU.
+func setDontFragment(conn net.PacketConn, ipVersion int) error {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return fmt.Errorf("%T does not support the DF bit", conn)
+	}
+	c, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	cerr := c.Control(func(fd uintptr) {
+		if ipVersion == 4 {
+			err = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_PROBE)
+		} else {
+			err = syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, syscall.IPV6_MTU_DISCOVER, syscall.IPV6_PMTUDISC_PROBE)
+		}
+	})
+	if cerr != nil {
+		return cerr
+	}
+	if err != nil {
+		return os.NewSyscallError("setsockopt", err)
+	}
+	return nil
+}
+
+// setTrafficClass marks every message sent by conn with the DSCP value,
+// the ECN bits of the TOS (traffic class for IPv6) stay 0
+func setTrafficClass(conn net.PacketConn, ipVersion int, dscp int) error {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return fmt.Errorf("%T does not support DSCP values", conn)
+	}
+	c, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	cerr := c.Control(func(fd uintptr) {
+		if ipVersion == 4 {
+			err = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TOS, dscp<<2)
+		} else {
+			err = syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, syscall.IPV6_TCLASS, dscp<<2)
+		}
+	})
+	if cerr != nil {
+		return cerr
+	}
+	if err != nil {
+		return os.NewSyscallError("setsockopt", err)
+	}
+	return nil
+}
+
+// writeMessage sends b to addr with the TTL (hop limit for IPv6) set to ttl
+func writeMessage(conn net.PacketConn, b []byte, addr net.Addr, ttl int) (int, error) {
+	oob := make([]byte, syscall.CmsgSpace(4))
+	h := (*syscall.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	if ip := addrIP(addr); ip.To4() != nil {
+		h.Level, h.Type = syscall.SOL_IP, syscall.IP_TTL
+	} else {
+		h.Level, h.Type = syscall.SOL_IPV6, syscall.IPV6_HOPLIMIT
+	}
+	h.SetLen(syscall.CmsgLen(4))
+	*(*int32)(unsafe.Pointer(&oob[syscall.CmsgLen(0)])) = int32(ttl)
+
+	switch c := conn.(type) {
+	case *net.IPConn:
+		n, _, err := c.WriteMsgIP(b, oob, addr.(*net.IPAddr))
+		return n, err
+	case *net.UDPConn:
+		n, _, err := c.WriteMsgUDP(b, oob, addr.(*net.UDPAddr))
+		return n, err
+	}
+	return 0, fmt.Errorf("%T does not support setting the TTL", conn)
+}
+
+// readMessage reads a message from conn, info.Received is the time the kernel received
+// the message, it is zero if timestamps are not enabled
+func readMessage(conn net.PacketConn, b []byte) (n int, addr net.Addr, info PacketInfo, err error) {
+	oob := make([]byte, 512)
+	var oobn int
+	switch c := conn.(type) {
+	case *net.IPConn:
+		var ipAddr *net.IPAddr
+		n, oobn, _, ipAddr, err = c.ReadMsgIP(b, oob)
+		if err != nil {
+			return n, nil, info, err
+		}
+		addr = ipAddr
+		// unlike ReadFrom, ReadMsgIP keeps the header of IPv4 packets
+		if ipAddr.IP.To4() != nil {
+			n = stripIPv4Header(n, b)
+		}
+	case *net.UDPConn:
+		return readPingSocket(c, b)
+	default:
+		n, addr, err = conn.ReadFrom(b)
+		return n, addr, info, err
+	}
+
+	parseControlMessages(oob[:oobn], &info)
+	return n, addr, info, nil
+}
+
+// sockExtendedErr is struct sock_extended_err of linux/errqueue.h
+type sockExtendedErr struct {
+	Errno  uint32
+	Origin uint8
+	Type   uint8
+	Code   uint8
+	Pad    uint8
+	Info   uint32
+	Data   uint32
+}
+
+const (
+	soEEOriginICMP  = 2
+	soEEOriginICMP6 = 3
+)
+
+// readPingSocket reads a message from a ping socket, ICMP errors are read from the error queue first.
+// For an error b gets the echo request the error was reported for.
+func readPingSocket(conn *net.UDPConn, b []byte) (n int, addr net.Addr, info PacketInfo, err error) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return 0, nil, info, err
+	}
+	oob := make([]byte, 512)
+	var oobn int
+	var from syscall.Sockaddr
+	var rerr error
+	var queued bool
+	err = rc.Read(func(fd uintptr) bool {
+		// a queued error does not always fail the next read, e.g. if a send reported it already
+		n, oobn, _, from, rerr = syscall.Recvmsg(int(fd), b, oob, syscall.MSG_ERRQUEUE)
+		if rerr == nil {
+			queued = true
+			return true
+		}
+		n, oobn, _, from, rerr = syscall.Recvmsg(int(fd), b, oob, 0)
+		// wait for the next message
+		return rerr != syscall.EAGAIN
+	})
+	if err != nil {
+		return 0, nil, info, err
+	}
+	if rerr != nil {
+		return 0, nil, info, os.NewSyscallError("recvmsg", rerr)
+	}
+	switch sa := from.(type) {
+	case *syscall.SockaddrInet4:
+		addr = &net.UDPAddr{IP: net.IP(sa.Addr[:]).To16()}
+	case *syscall.SockaddrInet6:
+		addr = &net.UDPAddr{IP: net.IP(sa.Addr[:])}
+	}
+	parseControlMessages(oob[:oobn], &info)
+	if queued && info.Error == nil {
+		return 0, nil, info, errors.New("no ICMP error in error queue")
+	}
+	return n, addr, info, nil
+}
+
+// parseControlMessages fills info with the control messages in oob
+func parseControlMessages(oob []byte, info *PacketInfo) {
+	cmsgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return
+	}
+	for _, cmsg := range cmsgs {
+		switch {
+		case cmsg.Header.Level == syscall.SOL_SOCKET && cmsg.Header.Type == syscall.SCM_TIMESTAMPNS:
+			if len(cmsg.Data) >= int(unsafe.Sizeof(syscall.Timespec{})) {
+				ts := (*syscall.Timespec)(unsafe.Pointer(&cmsg.Data[0]))
+				info.Received = time.Unix(ts.Unix())
+			}
+		case cmsg.Header.Level == syscall.SOL_IP && cmsg.Header.Type == syscall.IP_RECVERR,
+			cmsg.Header.Level == syscall.SOL_IPV6 && cmsg.Header.Type == syscall.IPV6_RECVERR:
+			size := int(unsafe.Sizeof(sockExtendedErr{}))
+			if len(cmsg.Data) < size {
+				continue
+			}
+			ee := (*sockExtendedErr)(unsafe.Pointer(&cmsg.Data[0]))
+			if ee.Origin != soEEOriginICMP && ee.Origin != soEEOriginICMP6 {
+				continue
+			}
+			info.Error = &QueuedError{
+				Type:     int(ee.Type),
+				Code:     int(ee.Code),
+				Info:     int(ee.Info),
+				Reporter: offender(cmsg.Data[size:]),
+			}
+		case cmsg.Header.Level == syscall.SOL_IP && cmsg.Header.Type == syscall.IP_TTL,
+			cmsg.Header.Level == syscall.SOL_IPV6 && cmsg.Header.Type == syscall.IPV6_HOPLIMIT:
+			// enabled by Listener.enableTTL
+			if len(cmsg.Data) >= 4 {
+				info.TTL = int(*(*int32)(unsafe.Pointer(&cmsg.Data[0])))
+			}
+		}
+	}
+}
+
+// offender returns the address of the sockaddr that follows a sock_extended_err (SO_EE_OFFENDER)
+func offender(b []byte) net.IP {
+	if len(b) < 2 {
+		return nil
+	}
+	family := *(*uint16)(unsafe.Pointer(&b[0]))
+	switch {
+	case family == syscall.AF_INET && len(b) >= syscall.SizeofSockaddrInet4:
+		return net.IP(append([]byte(nil), b[4:8]...)).To16()
+	case family == syscall.AF_INET6 && len(b) >= syscall.SizeofSockaddrInet6:
+		return net.IP(append([]byte(nil), b[8:24]...))
+	}
+	return nil
+}
+
+// stripIPv4Header removes the IPv4 header of the n bytes in b
+func stripIPv4Header(n int, b []byte) int {
+	if n < 20 || b[0]>>4 != 4 {
+		return n
+	}
+	l := int(b[0]&0x0f) << 2
+	if l < 20 || l > n {
+		return n
+	}
+	copy(b, b[l:n])
+	return n - l
+}
+
+// dialControl returns the Control function of a net.Dialer that binds its sockets to iface
+func dialControl(iface string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		return bindToDevice(c, iface)
+	}
+}
+
+func bindToDevice(c syscall.RawConn, iface string) error {
+	if iface == "" {
+		return nil
+	}
+	var err error
+	cerr := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, iface)
+	})
+	if cerr != nil {
+		return cerr
+	}
+	if err != nil {
+		return os.NewSyscallError("setsockopt", err)
+	}
+	return nil
+}
+
+func sockaddr(family int, address string) (syscall.Sockaddr, error) {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return nil, fmt.Errorf("'%s' is not a valid IP address", address)
+	}
+	switch family {
+	case syscall.AF_INET:
+		sa := &syscall.SockaddrInet4{}
+		if ip.To4() == nil {
+			return nil, fmt.Errorf("'%s' is not an IPv4 address", address)
+		}
+		copy(sa.Addr[:], ip.To4())
+		return sa, nil
+	default:
+		sa := &syscall.SockaddrInet6{}
+		if ip.To4() != nil {
+			return nil, fmt.Errorf("'%s' is not an IPv6 address", address)
+		}
+		copy(sa.Addr[:], ip.To16())
+		return sa, nil
+	}
+}
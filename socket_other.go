@@ -0,0 +1,79 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+	"syscall"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// listenPacket opens a raw (ip4:icmp, ip6:ipv6-icmp) or ping (udp4, udp6) socket on address,
+// binding to an interface is only supported on linux
+func listenPacket(network, address, iface string) (net.PacketConn, error) {
+	if iface != "" {
+		return nil, errors.New("binding to an interface is only supported on linux")
+	}
+	return icmp.ListenPacket(network, address)
+}
+
+// dialControl returns the Control function of a net.Dialer,
+// binding to an interface is only supported on linux
+func dialControl(iface string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		if iface != "" {
+			return errors.New("binding to an interface is only supported on linux")
+		}
+		return nil
+	}
+}
+
+// enableTimestamps is only supported on linux
+func enableTimestamps(conn net.PacketConn) error {
+	return errors.New("kernel timestamps are only supported on linux")
+}
+
+// setDontFragment is only supported on linux
+func setDontFragment(conn net.PacketConn, ipVersion int) error {
+	return errors.New("the DF bit is only supported on linux")
+}
+
+// setTrafficClass is only supported on linux
+func setTrafficClass(conn net.PacketConn, ipVersion int, dscp int) error {
+	return errors.New("DSCP values are only supported on linux")
+}
+
+// writeMessage is only supported on linux
+func writeMessage(conn net.PacketConn, b []byte, addr net.Addr, ttl int) (int, error) {
+	return 0, errors.New("setting the TTL is only supported on linux")
+}
+
+// readMessage reads a message from conn, info only has the TTL as
+// kernel timestamps and error queues are not supported
+func readMessage(conn net.PacketConn, b []byte) (n int, addr net.Addr, info PacketInfo, err error) {
+	if c, ok := conn.(*icmp.PacketConn); ok {
+		if p := c.IPv4PacketConn(); p != nil {
+			var cm *ipv4.ControlMessage
+			n, cm, addr, err = p.ReadFrom(b)
+			if cm != nil {
+				info.TTL = cm.TTL
+			}
+			return n, addr, info, err
+		}
+		if p := c.IPv6PacketConn(); p != nil {
+			var cm *ipv6.ControlMessage
+			n, cm, addr, err = p.ReadFrom(b)
+			if cm != nil {
+				info.TTL = cm.HopLimit
+			}
+			return n, addr, info, err
+		}
+	}
+	n, addr, err = conn.ReadFrom(b)
+	return n, addr, info, err
+}
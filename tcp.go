@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// probeTCP connects to Port of the peer in the background,
+// the time the handshake took gets sent to the collector
+func probeTCP(peer *Peer) error {
+	ip := peer.IP()
+	if ip == nil {
+		// hostname was not resolved yet
+		return nil
+	}
+	ipVersion := 6
+	if ip.To4() != nil {
+		ipVersion = 4
+	}
+	source, iface := peerSource(peer, ipVersion)
+	dialer := net.Dialer{
+		Timeout:   time.Duration(*peer.Timeout) * time.Millisecond,
+		LocalAddr: &net.TCPAddr{IP: net.ParseIP(source)},
+		Control:   dialControl(iface),
+	}
+	address := net.JoinHostPort(ip.String(), strconv.Itoa(*peer.Port))
+
+	go func() {
+		sent := time.Now()
+		received := sent
+		var conn net.Conn
+		err := inNamespace(peer.namespace(), func() (err error) {
+			// joining the namespace does not count
+			sent = time.Now()
+			conn, err = dialer.Dial("tcp", address)
+			received = time.Now()
+			return err
+		})
+		query := Query{
+			PeerID:       *peer.ID,
+			Time:         received.UTC().UnixNano() / 1000000,
+			ResponseTime: -1,
+			Outcome:      OutcomeOK,
+		}
+		if err == nil {
+			conn.Close()
+			query.ResponseTime = float64(received.Sub(sent)) / float64(time.Millisecond)
+		} else {
+			query.Outcome = dialOutcome(err)
+			log.Printf("Got %s for %s (%v)\n", query.Outcome, *peer.Name, err)
+		}
+		messages.In() <- query
+	}()
+	return nil
+}
+
+// dialOutcome returns the outcome of a connection that failed with err
+func dialOutcome(err error) string {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return OutcomeRefused
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return OutcomeTimeout
+	}
+	return OutcomeUnreachable
+}
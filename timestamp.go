@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+// millisecondsPerDay is the range of the times in ICMP timestamp messages
+const millisecondsPerDay = 24 * 60 * 60 * 1000
+
+// ICMPTimestamps are the times of an ICMP timestamp reply in Milliseconds since midnight UTC (RFC 792)
+type ICMPTimestamps struct {
+	// Originate is the time the request was sent at
+	Originate uint32
+	// Receive and Transmit are the times the peer received the request and sent the reply at
+	Receive  uint32
+	Transmit uint32
+}
+
+// millisecondsSinceMidnight returns the time of t in the format of ICMP timestamp messages
+func millisecondsSinceMidnight(t time.Time) float64 {
+	t = t.UTC()
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	return float64(t.Sub(midnight)) / float64(time.Millisecond)
+}
+
+// timestampDifference returns b - a in Milliseconds, for times on both sides of midnight as well
+func timestampDifference(a float64, b float64) float64 {
+	d := b - a
+	if d > millisecondsPerDay/2 {
+		d -= millisecondsPerDay
+	} else if d <= -millisecondsPerDay/2 {
+		d += millisecondsPerDay
+	}
+	return d
+}
+
+// sendTimestamp sends an ICMP timestamp request to ip of the peer,
+// the collector stores the delays and the clock offset of its reply
+func sendTimestamp(peer *Peer, ip net.IP, listener *Listener) error {
+	seq := peer.nextSeq()
+	echoID := listener.EchoID()
+	now := time.Now()
+
+	// identifier, sequence number and the originate, receive and transmit times
+	body := make([]byte, 16)
+	binary.BigEndian.PutUint16(body[0:], uint16(echoID))
+	binary.BigEndian.PutUint16(body[2:], uint16(seq))
+	binary.BigEndian.PutUint32(body[4:], uint32(millisecondsSinceMidnight(now)))
+	message := icmp.Message{
+		Type: ipv4.ICMPTypeTimestamp,
+		Body: &icmp.RawBody{Data: body},
+	}
+	bytes, err := message.Marshal(nil)
+	if err != nil {
+		return err
+	}
+
+	messages.In() <- Request{
+		EchoID:    echoID,
+		Seq:       seq,
+		IP:        ip,
+		Sent:      now,
+		Peer:      peer,
+		Listener:  listener,
+		Timestamp: true,
+	}
+	_, err = listener.WriteTo(bytes, listener.Addr(ip))
+	return err
+}
+
+// parseTimestampReply returns the response of an ICMP timestamp reply
+func parseTimestampReply(message *icmp.Message) (response Response, err error) {
+	body, ok := message.Body.(*icmp.RawBody)
+	if !ok || len(body.Data) < 16 {
+		return response, errors.New("invalid timestamp reply")
+	}
+	response.EchoID = int(binary.BigEndian.Uint16(body.Data[0:]))
+	response.Seq = int(binary.BigEndian.Uint16(body.Data[2:]))
+	response.Timestamps = &ICMPTimestamps{
+		Originate: binary.BigEndian.Uint32(body.Data[4:]),
+		Receive:   binary.BigEndian.Uint32(body.Data[8:]),
+		Transmit:  binary.BigEndian.Uint32(body.Data[12:]),
+	}
+	return response, nil
+}
+
+// clockSample returns the timestamps of the response to the timestamp request with the delays
+// and the clock offset they show, ok is false if the peer does not use standard times
+func clockSample(request *Request, response *Response) (sample ClockSample, ok bool) {
+	timestamps := response.Timestamps
+	// the high bit marks times that are not Milliseconds since midnight UTC
+	if timestamps.Receive&0x80000000 != 0 || timestamps.Transmit&0x80000000 != 0 {
+		return sample, false
+	}
+	// the local times are more precise than the originate time of the reply
+	originate := millisecondsSinceMidnight(request.Sent)
+	received := millisecondsSinceMidnight(response.Received)
+	// the peer cuts its times down to whole Milliseconds, the middle of them is closer
+	forward := timestampDifference(originate, float64(timestamps.Receive)+0.5)
+	back := timestampDifference(float64(timestamps.Transmit)+0.5, received)
+	return ClockSample{
+		PeerID:  *request.Peer.ID,
+		Time:    response.Received.UTC().UnixNano() / 1000000,
+		Forward: forward,
+		Return:  back,
+		// the peer is ahead by the offset if both directions take the same time
+		Offset:    (forward - back) / 2,
+		Originate: timestamps.Originate,
+		Receive:   timestamps.Receive,
+		Transmit:  timestamps.Transmit,
+	}, true
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClockSample(t *testing.T) {
+	id := int64(1)
+	peer := Peer{ID: &id}
+	tests := []struct {
+		name string
+		sent time.Time
+		// received is the time the reply arrived after it was sent
+		received   time.Duration
+		timestamps ICMPTimestamps
+		ok         bool
+		forward    float64
+		back       float64
+		offset     float64
+	}{
+		{"in sync", time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC), 20 * time.Millisecond, ICMPTimestamps{36000000, 36000009, 36000010}, true, 9.5, 9.5, 0},
+		{"ahead", time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC), 20 * time.Millisecond, ICMPTimestamps{36000000, 36000010, 36000011}, true, 10.5, 8.5, 1},
+		{"midnight", time.Date(2020, 1, 1, 23, 59, 59, 990000000, time.UTC), 20 * time.Millisecond, ICMPTimestamps{86399990, 0, 1}, true, 10.5, 8.5, 1},
+		{"not standard", time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC), 20 * time.Millisecond, ICMPTimestamps{36000000, 0x80000001, 0x80000001}, false, 0, 0, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := Request{Peer: &peer, Sent: test.sent}
+			timestamps := test.timestamps
+			response := Response{Received: test.sent.Add(test.received), Timestamps: &timestamps}
+			sample, ok := clockSample(&request, &response)
+			if ok != test.ok {
+				t.Fatalf("got ok %v, want %v", ok, test.ok)
+			}
+			if !ok {
+				return
+			}
+			if sample.Forward != test.forward || sample.Return != test.back || sample.Offset != test.offset {
+				t.Errorf("got %fms forward, %fms back and an offset of %fms, want %f, %f and %f",
+					sample.Forward, sample.Return, sample.Offset, test.forward, test.back, test.offset)
+			}
+			if sample.Originate != test.timestamps.Originate || sample.Receive != test.timestamps.Receive || sample.Transmit != test.timestamps.Transmit {
+				t.Errorf("got the timestamps %d, %d and %d, want %d, %d and %d", sample.Originate, sample.Receive, sample.Transmit,
+					test.timestamps.Originate, test.timestamps.Receive, test.timestamps.Transmit)
+			}
+		})
+	}
+}
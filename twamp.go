@@ -0,0 +1,420 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/ipv4"
+)
+
+// TWAMPPort is the port PeerTypeUDP sends its test packets to if Port of the peer is not set
+const TWAMPPort = 862
+
+// twampPacketLength is the length of an unauthenticated reflected test packet (RFC 5357 4.2.1),
+// the test packets get padded to it so both directions carry the same number of bytes
+const twampPacketLength = 41
+
+// twampSessionTimeout is the time after which the reflector forgets a sender that stopped sending
+const twampSessionTimeout = 15 * time.Minute
+
+// ntpEpochOffset is the number of seconds from the NTP epoch (1900) to the unix epoch
+const ntpEpochOffset = 2208988800
+
+// ntpTimestamp returns t in the 64 bit NTP format the test packets carry
+func ntpTimestamp(t time.Time) uint64 {
+	seconds := uint64(t.Unix() + ntpEpochOffset)
+	fraction := uint64(t.Nanosecond()) << 32 / 1e9
+	return seconds<<32 | fraction
+}
+
+// ntpTime returns the time of a 64 bit NTP timestamp
+func ntpTime(timestamp uint64) time.Time {
+	seconds := int64(timestamp>>32) - ntpEpochOffset
+	nanoseconds := int64((timestamp & 0xffffffff) * 1e9 >> 32)
+	return time.Unix(seconds, nanoseconds)
+}
+
+// twampReply is a reflected test packet
+type twampReply struct {
+	// Seq is the number of test packets the reflector reflected for the sender before this one
+	Seq uint32
+	// Sent and Received are the times the reflector sent the reply and received the test packet at
+	Sent     time.Time
+	Received time.Time
+	// SenderSeq is the sequence number of the test packet
+	SenderSeq uint32
+	// Arrived is the time the reply arrived at, it contains a monotonic clock reading
+	Arrived time.Time
+	// Err is set instead if the reflector could not be reached
+	Err error
+}
+
+// twampSession sends the test packets of a peer through its own socket,
+// so the reflector can keep the sequence numbers of every sender apart
+type twampSession struct {
+	peer    *Peer
+	ip      net.IP
+	conn    net.Conn
+	replies chan twampReply
+	done    chan struct{}
+	seq     uint32
+	// pending holds the time every test packet without a reply was sent at by its sequence number
+	pending map[uint32]time.Time
+	// the last reply that arrived in order
+	received         bool
+	lastSeq          uint32
+	lastReflectorSeq uint32
+	lastForward      time.Duration
+	lastBackward     time.Duration
+}
+
+// newTWAMPSession opens a socket to the reflector of the peer at ip
+func newTWAMPSession(peer *Peer, ip net.IP) (*twampSession, error) {
+	ipVersion := 6
+	if ip.To4() != nil {
+		ipVersion = 4
+	}
+	source, iface := peerSource(peer, ipVersion)
+	port := TWAMPPort
+	if peer.Port != nil {
+		port = *peer.Port
+	}
+	dialer := net.Dialer{
+		LocalAddr: &net.UDPAddr{IP: net.ParseIP(source)},
+		Control:   dialControl(iface),
+	}
+	var conn net.Conn
+	err := inNamespace(peer.namespace(), func() (err error) {
+		conn, err = dialer.Dial("udp", net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if peer.dscp() > 0 {
+		if err = setTrafficClass(conn.(*net.UDPConn), ipVersion, peer.dscp()); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	session := &twampSession{
+		peer:    peer,
+		ip:      ip,
+		conn:    conn,
+		replies: make(chan twampReply, 16),
+		done:    make(chan struct{}),
+		pending: map[uint32]time.Time{},
+	}
+	go session.read()
+	return session, nil
+}
+
+// read passes the replies to the session until it gets closed
+func (session *twampSession) read() {
+	b := make([]byte, 65535)
+	for {
+		var reply twampReply
+		n, err := session.conn.Read(b)
+		reply.Arrived = time.Now()
+		switch {
+		case errors.Is(err, syscall.ECONNREFUSED):
+			// the reflector is not listening, the socket stays usable
+			reply.Err = err
+		case err != nil:
+			return
+		case n < twampPacketLength:
+			continue
+		default:
+			reply.Seq = binary.BigEndian.Uint32(b[0:])
+			reply.Sent = ntpTime(binary.BigEndian.Uint64(b[4:]))
+			reply.Received = ntpTime(binary.BigEndian.Uint64(b[16:]))
+			reply.SenderSeq = binary.BigEndian.Uint32(b[24:])
+		}
+		select {
+		case session.replies <- reply:
+		case <-session.done:
+			return
+		}
+	}
+}
+
+// close closes the socket of the session and stops reading from it
+func (session *twampSession) close() {
+	close(session.done)
+	session.conn.Close()
+}
+
+// send sends the next test packet
+func (session *twampSession) send() error {
+	b := make([]byte, twampPacketLength)
+	now := time.Now()
+	binary.BigEndian.PutUint32(b[0:], session.seq)
+	binary.BigEndian.PutUint64(b[4:], ntpTimestamp(now))
+	// the error estimate of an unsynchronized clock with a multiplier of 1
+	binary.BigEndian.PutUint16(b[12:], 1)
+	_, err := session.conn.Write(b)
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		// the error belongs to an earlier test packet, it fails the next write
+		session.handle(twampReply{Err: err})
+		_, err = session.conn.Write(b)
+	}
+	if err != nil {
+		return err
+	}
+	session.pending[session.seq] = now
+	session.seq++
+	return nil
+}
+
+// query returns the query of a reply to a pending test packet
+func (session *twampSession) query(reply twampReply, sent time.Time) Query {
+	query := Query{
+		PeerID:  *session.peer.ID,
+		Time:    reply.Arrived.UTC().UnixNano() / 1000000,
+		Outcome: OutcomeOK,
+	}
+	if session.received && reply.SenderSeq <= session.lastSeq {
+		// it was counted as lost when the reply to the later one arrived,
+		// the session keeps comparing the replies with that one
+		query.ResponseTime = -1
+		query.Outcome = OutcomeLate
+		query.Reordered = true
+		return query
+	}
+
+	// the time the reflector needed does not count
+	processing := reply.Sent.Sub(reply.Received)
+	if processing < 0 {
+		processing = 0
+	}
+	query.ResponseTime = float64(reply.Arrived.Sub(sent)-processing) / float64(time.Millisecond)
+	// the one way delays contain the offset of the clocks, their changes do not
+	forward := reply.Received.Sub(sent)
+	backward := reply.Arrived.Sub(reply.Sent)
+	reflectorSeq := reply.Seq
+	if session.received {
+		sentSince := int64(reply.SenderSeq) - int64(session.lastSeq)
+		reflectedSince := int64(reply.Seq) - int64(session.lastReflectorSeq)
+		switch {
+		case reflectedSince <= 0 && int64(reply.Seq) < sentSince:
+			// a restarted reflector counts from 0 again
+		case reflectedSince <= 0:
+			// the reflector got this test packet before the last one, that one got counted as reordered
+			reflectorSeq = session.lastReflectorSeq
+		case reflectedSince > sentSince:
+			// the reflector got a later test packet before this one
+			query.Reordered = true
+		default:
+			query.ForwardLoss = int(sentSince - reflectedSince)
+			query.BackwardLoss = int(reflectedSince - 1)
+		}
+		query.ForwardDelayVariation = float64(forward-session.lastForward) / float64(time.Millisecond)
+		query.BackwardDelayVariation = float64(backward-session.lastBackward) / float64(time.Millisecond)
+	} else if reply.Seq <= reply.SenderSeq {
+		// the reflector started counting with the first test packet
+		query.ForwardLoss = int(reply.SenderSeq - reply.Seq)
+	}
+	session.received = true
+	session.lastSeq = reply.SenderSeq
+	session.lastReflectorSeq = reflectorSeq
+	session.lastForward = forward
+	session.lastBackward = backward
+	return query
+}
+
+// handle sends the query of a reply to the collector
+func (session *twampSession) handle(reply twampReply) {
+	if reply.Err != nil {
+		// every test packet that is still pending was refused
+		for seq := range session.pending {
+			log.Printf("Got %s for %s (%v)\n", OutcomeRefused, *session.peer.Name, reply.Err)
+			session.finish(seq, OutcomeRefused)
+		}
+		return
+	}
+	sent, ok := session.pending[reply.SenderSeq]
+	if !ok {
+		// a duplicate or the reply to a test packet that timed out already
+		return
+	}
+	delete(session.pending, reply.SenderSeq)
+	messages.In() <- session.query(reply, sent)
+}
+
+// expire sends a timeout for every test packet that is pending longer than the Timeout of the peer
+func (session *twampSession) expire() {
+	timeout := time.Duration(*session.peer.Timeout) * time.Millisecond
+	for seq, sent := range session.pending {
+		if time.Since(sent) >= timeout {
+			log.Printf("Got Timeout for %s\n", *session.peer.Name)
+			session.finish(seq, OutcomeTimeout)
+		}
+	}
+}
+
+// finish removes a pending test packet that did not get a reply
+func (session *twampSession) finish(seq uint32, outcome string) {
+	delete(session.pending, seq)
+	messages.In() <- Query{
+		PeerID:       *session.peer.ID,
+		Time:         time.Now().UTC().UnixNano() / 1000000,
+		ResponseTime: -1,
+		Outcome:      outcome,
+	}
+}
+
+// udpJob returns the job that makes the udpRoutine of the peer send its next test packet
+func udpJob(peer *Peer, sends chan<- struct{}) *job {
+	return &job{
+		interval: time.Duration(*peer.Interval) * time.Millisecond,
+		packets:  1,
+		run: func(*packetBudget, <-chan struct{}) {
+			select {
+			case sends <- struct{}{}:
+			default:
+				// the routine did not send the last one yet
+			}
+		},
+	}
+}
+
+// udpRoutine sends a test packet to the reflector of the peer every time the scheduler runs its udpJob
+func udpRoutine(peer *Peer, sends <-chan struct{}) {
+	// Subscribe to quitChannel
+	quitChannel := quitChannel.Add()
+	timeoutTicker := time.NewTicker(100 * time.Millisecond)
+	var session *twampSession
+	var replies chan twampReply
+	for {
+		select {
+		case <-quitChannel:
+			if session != nil {
+				session.close()
+			}
+			quitChannel <- true
+			return
+		case reply := <-replies:
+			session.handle(reply)
+		case <-timeoutTicker.C:
+			if session != nil {
+				session.expire()
+			}
+		case <-sends:
+			// a new address needs a new session
+			if ip := peer.IP(); ip != nil && (session == nil || !session.ip.Equal(ip)) {
+				if session != nil {
+					session.close()
+				}
+				var err error
+				if session, err = newTWAMPSession(peer, ip); err != nil {
+					log.Printf("Unable to open a session to %s: %v\n", *peer.Name, err)
+				} else {
+					replies = session.replies
+				}
+			}
+			if session != nil {
+				if err := session.send(); err != nil {
+					log.Printf("Unable to send a test packet to %s: %v\n", *peer.Name, err)
+				}
+			}
+		}
+	}
+}
+
+// reflectorSession is a sender the reflector reflected test packets for
+type reflectorSession struct {
+	seq      uint32
+	lastSeen time.Time
+}
+
+// runReflector answers the test packets of PeerTypeUDP peers and other TWAMP light senders on address
+func runReflector(address string) error {
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	log.Printf("Reflecting on %s\n", conn.LocalAddr())
+	return reflect(conn)
+}
+
+// reflect answers the test packets that arrive on conn until it gets closed
+func reflect(conn net.PacketConn) error {
+	// the TTL of the test packet is part of the reply, 255 stands for unknown
+	packetConn := ipv4.NewPacketConn(conn)
+	if err := packetConn.SetControlMessage(ipv4.FlagTTL, true); err != nil {
+		log.Printf("Unable to receive the TTL on %s: %v\n", conn.LocalAddr(), err)
+	}
+
+	sessions := map[string]*reflectorSession{}
+	lastExpiry := time.Now()
+	b := make([]byte, 65535)
+	for {
+		n, cm, addr, err := packetConn.ReadFrom(b)
+		received := time.Now()
+		if err != nil {
+			return err
+		}
+		if n < 14 {
+			continue
+		}
+
+		if received.Sub(lastExpiry) > time.Minute {
+			for key, session := range sessions {
+				if received.Sub(session.lastSeen) > twampSessionTimeout {
+					delete(sessions, key)
+				}
+			}
+			lastExpiry = received
+		}
+		session, ok := sessions[addr.String()]
+		if !ok {
+			session = &reflectorSession{}
+			sessions[addr.String()] = session
+		}
+		session.lastSeen = received
+
+		// the reply is as long as the test packet
+		length := n
+		if length < twampPacketLength {
+			length = twampPacketLength
+		}
+		reply := make([]byte, length)
+		binary.BigEndian.PutUint32(reply[0:], session.seq)
+		binary.BigEndian.PutUint16(reply[12:], 1)
+		binary.BigEndian.PutUint64(reply[16:], ntpTimestamp(received))
+		// sequence number, timestamp and error estimate of the sender
+		copy(reply[24:38], b[0:14])
+		reply[40] = 255
+		if cm != nil && cm.TTL > 0 {
+			reply[40] = byte(cm.TTL)
+		}
+		binary.BigEndian.PutUint64(reply[4:], ntpTimestamp(time.Now()))
+		if _, err = conn.WriteTo(reply, addr); err != nil {
+			log.Printf("Unable to reflect to %s: %v\n", addr, err)
+			continue
+		}
+		session.seq++
+	}
+}
+
+// reflectCommand runs icmpmon as a reflector for PeerTypeUDP peers
+func reflectCommand(args []string) int {
+	flags := flag.NewFlagSet("reflect", flag.ContinueOnError)
+	address := flags.String("listen", fmt.Sprintf(":%d", TWAMPPort), "address to reflect test packets on")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	if err := runReflector(*address); err != nil {
+		log.Println(err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"gopkg.in/eapache/channels.v1"
+)
+
+func TestNTPTimestamp(t *testing.T) {
+	now := time.Now()
+	if d := ntpTime(ntpTimestamp(now)).Sub(now); d < -time.Microsecond || d > time.Microsecond {
+		t.Fatalf("got %s after the round trip", d)
+	}
+}
+
+// startTestReflector starts a reflector on address, closing the returned conn stops it
+func startTestReflector(t *testing.T, address string) net.PacketConn {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go reflect(conn)
+	return conn
+}
+
+// reflected sends the next test packet of the session and returns its reply
+func reflected(t *testing.T, session *twampSession) twampReply {
+	t.Helper()
+	if err := session.send(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case reply := <-session.replies:
+		return reply
+	case <-time.After(2 * time.Second):
+		t.Fatal("got no reply")
+	}
+	return twampReply{}
+}
+
+// handled passes the reply to the session and returns the query it sent to the collector
+func handled(t *testing.T, session *twampSession, reply twampReply) Query {
+	t.Helper()
+	session.handle(reply)
+	select {
+	case message := <-messages.Out():
+		return message.(Query)
+	case <-time.After(2 * time.Second):
+		t.Fatal("got no query")
+	}
+	return Query{}
+}
+
+func TestTWAMPSession(t *testing.T) {
+	reflector := startTestReflector(t, "127.0.0.1:0")
+	address := reflector.LocalAddr().String()
+	port := reflector.LocalAddr().(*net.UDPAddr).Port
+	peers := useTestConfig(t, "{\nPeers: [\n{\nType: udp\nAddress: 127.0.0.1\nPort: "+strconv.Itoa(port)+"\n}\n]\n}")
+	messages = channels.NewRingChannel(16)
+	session, err := newTWAMPSession(&peers[0], peers[0].IP())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.close()
+
+	expect := func(step string, query Query, outcome string, forwardLoss int, backwardLoss int, reordered bool) {
+		t.Helper()
+		if query.Outcome != outcome || query.ForwardLoss != forwardLoss || query.BackwardLoss != backwardLoss || query.Reordered != reordered {
+			t.Fatalf("%s: got %s, %d lost forward, %d lost backward, reordered %v, want %s, %d, %d, %v", step,
+				query.Outcome, query.ForwardLoss, query.BackwardLoss, query.Reordered, outcome, forwardLoss, backwardLoss, reordered)
+		}
+		if (query.ResponseTime >= 0) != (outcome == OutcomeOK) {
+			t.Fatalf("%s: got the response time %f for %s", step, query.ResponseTime, query.Outcome)
+		}
+	}
+
+	before := time.Now()
+	reply := reflected(t, session)
+	if reply.Seq != 0 || reply.SenderSeq != 0 {
+		t.Fatalf("got the sequence numbers %d and %d of the first reply", reply.Seq, reply.SenderSeq)
+	}
+	// the timestamps of the reflector have the precision of the NTP format
+	if reply.Received.Before(before.Add(-time.Microsecond)) || reply.Sent.Before(reply.Received) || reply.Sent.After(reply.Arrived.Add(time.Microsecond)) {
+		t.Fatalf("got the timestamps %s and %s for a test packet sent at %s", reply.Received, reply.Sent, before)
+	}
+	expect("first", handled(t, session, reply), OutcomeOK, 0, 0, false)
+	expect("second", handled(t, session, reflected(t, session)), OutcomeOK, 0, 0, false)
+
+	// the test packet 2 gets lost on the way to the reflector
+	session.seq++
+	expect("forward loss", handled(t, session, reflected(t, session)), OutcomeOK, 1, 0, false)
+
+	// the reply to the test packet 4 gets lost on the way back
+	reply = reflected(t, session)
+	delete(session.pending, reply.SenderSeq)
+	expect("backward loss", handled(t, session, reflected(t, session)), OutcomeOK, 0, 1, false)
+
+	// the replies to 6 and 7 arrive the other way around,
+	// the late one was counted as lost already
+	first, second := reflected(t, session), reflected(t, session)
+	expect("overtaking", handled(t, session, second), OutcomeOK, 0, 1, false)
+	expect("late", handled(t, session, first), OutcomeLate, 0, 0, true)
+	expect("after the late one", handled(t, session, reflected(t, session)), OutcomeOK, 0, 0, false)
+
+	// the test packet 10 overtakes 9 on the way to the reflector
+	seq := session.seq
+	session.seq = seq + 1
+	second = reflected(t, session)
+	session.seq = seq
+	first = reflected(t, session)
+	session.seq = seq + 2
+	if first.Seq != second.Seq+1 {
+		t.Fatalf("the reflector got the test packets in the order %d, %d", second.Seq, first.Seq)
+	}
+	expect("overtaken", handled(t, session, first), OutcomeOK, 0, 0, true)
+	expect("overtaking on the way there", handled(t, session, second), OutcomeOK, 0, 0, false)
+	// the loss after the reordering still counts
+	reply = reflected(t, session)
+	delete(session.pending, reply.SenderSeq)
+	expect("after the reordering", handled(t, session, reflected(t, session)), OutcomeOK, 0, 1, false)
+
+	// the restarted reflector counts from 0 again
+	reflector.Close()
+	reflector = startTestReflector(t, address)
+	reply = reflected(t, session)
+	if reply.Seq != 0 {
+		t.Fatalf("got the sequence number %d from the restarted reflector", reply.Seq)
+	}
+	expect("restarted", handled(t, session, reply), OutcomeOK, 0, 0, false)
+	expect("after the restart", handled(t, session, reflected(t, session)), OutcomeOK, 0, 0, false)
+
+	reflector.Close()
+	reply = reflected(t, session)
+	if reply.Err == nil {
+		t.Fatal("got a reply from the stopped reflector")
+	}
+	expect("refused", handled(t, session, reply), OutcomeRefused, 0, 0, false)
+}